@@ -1,25 +1,31 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/shzuzu/Go_Calculator/internal/application"
+	"github.com/shzuzu/Go_Calculator/internal/auth"
 	"github.com/shzuzu/Go_Calculator/internal/database/database"
+	"github.com/shzuzu/Go_Calculator/internal/database/repo"
 	calcGrpc "github.com/shzuzu/Go_Calculator/internal/grpc"
 )
 
 func main() {
-	mode := flag.String("mode", "console", "Application operating mode: console, server, or calc-server")
+	mode := flag.String("mode", "console", "Application operating mode: console, server, agent, or calc-server. The server computes in-process unless GRPC_SERVER_ADDRESS lists calc servers")
+	migrate := flag.String("migrate", "", "Apply pending database migrations (up) or revert the latest one (down), then exit")
+	storage := flag.String("storage", "database", "Where to keep users and expressions: database (DATABASE_URL) or memory")
 	flag.Parse()
 
 	if len(os.Args) < 2 {
-		fmt.Println("Please choose the mode, use --mode=console, --mode=server, or --mode=calc-server")
+		fmt.Println("Please choose the mode, use --mode=console, --mode=server, --mode=agent, or --mode=calc-server")
 		os.Exit(1)
 	}
 
@@ -33,43 +39,125 @@ func main() {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
 
-	db, err := database.InitDB("./calculator.db")
-	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	if *migrate != "" {
+		runMigrations(application.ConfigFromEnv().DatabaseURL, *migrate)
+		return
+	}
+
+	// агенту база данных не нужна: задачи он получает от оркестратора
+	if *mode == "agent" {
+		fmt.Println("Starting agent...")
+		err := application.RunAgent(application.ConfigFromEnv())
+		if err != nil {
+			fmt.Println("Agent stopped with error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// calc-server только считает по gRPC: без HTTP и базы данных
+	if *mode == "calc-server" {
+		config := application.ConfigFromEnv()
+		fmt.Println("Starting gRPC calculator server...")
+		err := application.RunCalcServer(config)
+		if err != nil {
+			fmt.Println("Calc server stopped with error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var expressions repo.ExpressionStore
+	var users auth.UserStore
+	switch *storage {
+	case "database":
+		db, err := database.InitDB(application.ConfigFromEnv().DatabaseURL)
+		if err != nil {
+			log.Fatalf("Failed to initialize database: %v", err)
+		}
+		defer db.Close()
+		expressions, users = repo.NewRepository(db), auth.NewSQLUserStore(db)
+	case "memory":
+		// все данные пропадут после остановки сервера
+		log.Println("Keeping users and expressions in memory")
+		expressions, users = repo.NewMemoryRepository(), auth.NewMemoryUserStore()
+	default:
+		fmt.Println("Unknown storage. Use --storage=database or --storage=memory")
+		os.Exit(1)
 	}
-	defer db.Close()
 
 	switch *mode {
 	case "":
-		fmt.Println("Please choose the mode, use --mode=console, --mode=server, or --mode=calc-server")
+		fmt.Println("Please choose the mode, use --mode=console, --mode=server, --mode=agent, or --mode=calc-server")
 		os.Exit(1)
 	case "console":
 		fmt.Println("Starting calculator in console mode...")
-		app := application.New(db, nil)
+		app := application.New(expressions, users, nil)
 		app.Run()
 	case "server":
 		fmt.Println("Starting HTTP-server...")
-		grpcClient, err := calcGrpc.NewCalculatorClient("localhost:50051")
-		if err != nil {
-			log.Fatalf("Failed to create gRPC client: %v", err)
-		}
-		defer grpcClient.Close()
+		// без GRPC_SERVER_ADDRESS сервер считает сам, иначе calc-server должны быть запущены
+		var grpcClient *calcGrpc.CalculatorClient
+		if servers := application.ConfigFromEnv().CalcServers; len(servers) > 0 {
+			grpcClient, err = calcGrpc.NewCalculatorClient(servers...)
+			if err != nil {
+				log.Fatalf("Failed to create gRPC client: %v", err)
+			}
+			defer grpcClient.Close()
 
-		app := application.New(db, grpcClient)
-		go func() {
-			fmt.Println("Starting gRPC calculator server...")
-			err := calcGrpc.StartServer(":50051")
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err = grpcClient.WaitReady(ctx)
+			cancel()
 			if err != nil {
-				log.Fatalf("Failed to start gRPC server: %v", err)
+				log.Fatalf("%v. Start it with --mode=calc-server or unset GRPC_SERVER_ADDRESS to compute in-process", err)
 			}
-		}()
+		}
+
+		app := application.New(expressions, users, grpcClient)
 		err = app.RunServer()
 		if err != nil {
 			fmt.Println("Error via starting the server:", err)
 			os.Exit(1)
 		}
 	default:
-		fmt.Println("Unknown mode. Use --mode=console, --mode=server, or --mode=calc-server")
+		fmt.Println("Unknown mode. Use --mode=console, --mode=server, --mode=agent, or --mode=calc-server")
+		os.Exit(1)
+	}
+}
+
+// runMigrations applies or reverts migrations of the database at dsn.
+// Other modes apply pending migrations on start anyway.
+func runMigrations(dsn, direction string) {
+	db, err := database.Open(dsn)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	migrator, err := database.NewMigrator(db)
+	if err != nil {
+		log.Fatalf("Failed to load migrations: %v", err)
+	}
+
+	switch direction {
+	case "up":
+		applied, err := migrator.Up()
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		fmt.Printf("Applied %d migrations\n", applied)
+	case "down":
+		version, err := migrator.Down()
+		if err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		if version == 0 {
+			fmt.Println("No migrations to revert")
+			return
+		}
+		fmt.Printf("Reverted migration %d\n", version)
+	default:
+		fmt.Println("Unknown migration direction. Use --migrate=up or --migrate=down")
 		os.Exit(1)
 	}
 }
@@ -86,9 +174,17 @@ func createEnv(envPath string) {
 	TIME_SUBTRACTION_MS=0
 	TIME_MULTIPLICATION_MS=0
 	TIME_DIVISION_MS=0
+	TIME_POWER_MS=0
+	TIME_MODULO_MS=0
+	TIME_INT_DIVISION_MS=0
 	COMPUTING_POWER=3
-	GRPC_SERVER_ADDRESS=localhost:50051
+	QUEUE_CAPACITY=100
+	GRPC_LISTEN_ADDRESS=localhost:50051
+	ORCHESTRATOR_URL=http://localhost:8080
 	JWT_SECRET=golang
+	DATABASE_URL=./calculator.db
+	WEBHOOK_SECRET=golang-webhooks
+	AGENT_TOKEN=golang-agents
 	`
 	d1 := []byte(envVars)
 	err := os.WriteFile(envPath, d1, 0644)
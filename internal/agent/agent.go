@@ -0,0 +1,156 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/pkg/calc"
+)
+
+// Task is a single operation handed out by the orchestrator on
+// GET /internal/task.
+type Task struct {
+	ID        int64     `json:"id"`
+	Operation string    `json:"operation"`
+	Args      []float64 `json:"args"`
+}
+
+// TaskResult is posted back to the orchestrator on POST /internal/task.
+// Error is set instead of Result when the operation failed.
+type TaskResult struct {
+	ID     int64   `json:"id"`
+	Result float64 `json:"result"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// Agent runs operations for an orchestrator. Each of its workers fetches a
+// task, computes it with the configured operation delays and posts the
+// result back.
+type Agent struct {
+	orchestratorURL string
+	// token is sent as a bearer token; the orchestrator rejects agents
+	// without its AGENT_TOKEN
+	token        string
+	workers      int
+	evaluator    *calc.Evaluator
+	client       *http.Client
+	pollInterval time.Duration
+}
+
+func New(orchestratorURL, token string, workers int, evaluator *calc.Evaluator) *Agent {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Agent{
+		orchestratorURL: strings.TrimRight(orchestratorURL, "/"),
+		token:           token,
+		workers:         workers,
+		evaluator:       evaluator,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		pollInterval:    100 * time.Millisecond,
+	}
+}
+
+// Run starts the workers and blocks until ctx is done.
+func (a *Agent) Run(ctx context.Context) error {
+	log.Printf("Agent: starting %d workers for %s", a.workers, a.orchestratorURL)
+	var wg sync.WaitGroup
+	for i := 0; i < a.workers; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			a.worker(ctx, n)
+		}(i)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (a *Agent) worker(ctx context.Context, n int) {
+	for ctx.Err() == nil {
+		task, err := a.fetchTask(ctx)
+		if err != nil {
+			log.Printf("Agent worker %d: failed to fetch task: %v", n, err)
+		}
+		if task == nil {
+			select {
+			case <-time.After(a.pollInterval):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		log.Printf("Agent worker %d: computing task %d: %s %v", n, task.ID, task.Operation, task.Args)
+		result := TaskResult{ID: task.ID}
+		value, err := a.evaluator.Apply(ctx, task.Operation, task.Args)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Result = value
+		}
+
+		if err := a.postResult(ctx, result); err != nil {
+			log.Printf("Agent worker %d: failed to post result of task %d: %v", n, task.ID, err)
+		}
+	}
+}
+
+// fetchTask returns nil without an error when the orchestrator has nothing
+// to do.
+func (a *Agent) fetchTask(ctx context.Context) (*Task, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.orchestratorURL+"/internal/task", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		task := &Task{}
+		if err := json.NewDecoder(resp.Body).Decode(task); err != nil {
+			return nil, err
+		}
+		return task, nil
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+func (a *Agent) postResult(ctx context.Context, result TaskResult) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.orchestratorURL+"/internal/task", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+a.token)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// 404 means the orchestrator no longer waits for this task
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package agent_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/agent"
+	"github.com/shzuzu/Go_Calculator/pkg/calc"
+)
+
+func TestAgentComputesTasks(t *testing.T) {
+	var mu sync.Mutex
+	tasks := []agent.Task{
+		{ID: 1, Operation: "+", Args: []float64{2, 3}},
+		{ID: 2, Operation: "/", Args: []float64{1, 0}},
+		{ID: 3, Operation: "max", Args: []float64{1, 7, 4}},
+	}
+	results := make(chan agent.TaskResult, len(tasks))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/internal/task" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer agent-token" {
+			t.Errorf("Unexpected Authorization header %q", r.Header.Get("Authorization"))
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			mu.Lock()
+			defer mu.Unlock()
+			if len(tasks) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(tasks[0])
+			tasks = tasks[1:]
+		case http.MethodPost:
+			var result agent.TaskResult
+			if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+				t.Errorf("Failed to decode result: %v", err)
+			}
+			results <- result
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agent.New(server.URL, "agent-token", 2, calc.NewEvaluator(calc.Config{})).Run(ctx)
+
+	got := make(map[int64]agent.TaskResult)
+	for len(got) < 3 {
+		select {
+		case result := <-results:
+			got[result.ID] = result
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for results, got %v", got)
+		}
+	}
+
+	if got[1].Result != 5 || got[1].Error != "" {
+		t.Fatalf("Expected 5 for task 1, got %+v", got[1])
+	}
+	if got[2].Error != calc.ErrDivisionByZero.Error() {
+		t.Fatalf("Expected division by zero for task 2, got %+v", got[2])
+	}
+	if got[3].Result != 7 {
+		t.Fatalf("Expected 7 for task 3, got %+v", got[3])
+	}
+}
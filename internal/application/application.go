@@ -2,22 +2,36 @@ package application
 
 import (
 	"bufio"
-	"database/sql"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/shzuzu/Go_Calculator/internal/agent"
 	"github.com/shzuzu/Go_Calculator/internal/auth"
+	"github.com/shzuzu/Go_Calculator/internal/database/repo"
 	calcGrpc "github.com/shzuzu/Go_Calculator/internal/grpc"
 	"github.com/shzuzu/Go_Calculator/internal/middleware"
+	"github.com/shzuzu/Go_Calculator/internal/webhook"
 	"github.com/shzuzu/Go_Calculator/pkg/calc"
 )
 
 type Config struct {
-	Addr           string
-	GrpcServerAddr string
+	Addr            string
+	GrpcServerAddr  string
+	CalcServers     []string
+	OrchestratorURL string
+	ComputingPower  int
+	QueueCapacity   int
+	WebhookSecret   string
+	AgentToken      string
+	DatabaseURL     string
+	Calc            calc.Config
 }
 
 func ConfigFromEnv() *Config {
@@ -28,25 +42,96 @@ func ConfigFromEnv() *Config {
 		config.Addr = "8080"
 	}
 
-	config.GrpcServerAddr = os.Getenv("GRPC_SERVER_ADDRESS")
+	// сервер может работать с несколькими calc-server: адреса через запятую;
+	// без них он считает сам, в своем процессе
+	for _, addr := range strings.Split(os.Getenv("GRPC_SERVER_ADDRESS"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			config.CalcServers = append(config.CalcServers, addr)
+		}
+	}
+
+	// calc-server слушает GRPC_LISTEN_ADDRESS; если он не задан — первый
+	// адрес из списка, как раньше, когда оба режима читали одну переменную
+	config.GrpcServerAddr = os.Getenv("GRPC_LISTEN_ADDRESS")
+	if config.GrpcServerAddr == "" && len(config.CalcServers) > 0 {
+		config.GrpcServerAddr = config.CalcServers[0]
+	}
 	if config.GrpcServerAddr == "" {
 		config.GrpcServerAddr = "localhost:50051"
 	}
 
+	config.OrchestratorURL = os.Getenv("ORCHESTRATOR_URL")
+	if config.OrchestratorURL == "" {
+		config.OrchestratorURL = "http://localhost:" + config.Addr
+	}
+
+	config.ComputingPower, _ = strconv.Atoi(os.Getenv("COMPUTING_POWER"))
+	if config.ComputingPower < 1 {
+		config.ComputingPower = 3
+	}
+
+	config.QueueCapacity = 100
+	if capacity, err := strconv.Atoi(os.Getenv("QUEUE_CAPACITY")); err == nil {
+		config.QueueCapacity = capacity
+	}
+
+	// postgres://... для PostgreSQL, иначе путь к файлу SQLite
+	config.DatabaseURL = os.Getenv("DATABASE_URL")
+	if config.DatabaseURL == "" {
+		config.DatabaseURL = "./calculator.db"
+	}
+
+	// без секрета колбэки отключены: неподписанные запросы не отправляем
+	config.WebhookSecret = os.Getenv("WEBHOOK_SECRET")
+
+	// общий секрет оркестратора и агентов; без него агенты не подключатся
+	config.AgentToken = os.Getenv("AGENT_TOKEN")
+
+	config.Calc = calc.Config{
+		AdditionDelay:       durationFromEnv("TIME_ADDITION_MS"),
+		SubtractionDelay:    durationFromEnv("TIME_SUBTRACTION_MS"),
+		MultiplicationDelay: durationFromEnv("TIME_MULTIPLICATION_MS"),
+		DivisionDelay:       durationFromEnv("TIME_DIVISION_MS"),
+		PowerDelay:          durationFromEnv("TIME_POWER_MS"),
+		ModuloDelay:         durationFromEnv("TIME_MODULO_MS"),
+		IntDivisionDelay:    durationFromEnv("TIME_INT_DIVISION_MS"),
+	}
+
 	return config
 }
 
+// durationFromEnv reads a number of milliseconds; missing or malformed
+// values mean no delay.
+func durationFromEnv(key string) time.Duration {
+	ms, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		if os.Getenv(key) != "" {
+			log.Printf("Invalid value of %s: %v", key, err)
+		}
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
 type Application struct {
 	config           *Config
-	db               *sql.DB
+	evaluator        *calc.Evaluator
+	expressions      repo.ExpressionStore
+	users            auth.UserStore
 	calculatorClient *calcGrpc.CalculatorClient
+	// переменные консольного режима, заданные через "r = 3"
+	variables map[string]float64
 }
 
-func New(db *sql.DB, calculatorClient *calcGrpc.CalculatorClient) *Application {
+func New(expressions repo.ExpressionStore, users auth.UserStore, calculatorClient *calcGrpc.CalculatorClient) *Application {
+	config := ConfigFromEnv()
 	return &Application{
-		config:           ConfigFromEnv(),
-		db:               db,
+		config:           config,
+		evaluator:        calc.NewEvaluator(config.Calc),
+		expressions:      expressions,
+		users:            users,
 		calculatorClient: calculatorClient,
+		variables:        make(map[string]float64),
 	}
 }
 
@@ -65,8 +150,11 @@ func (a *Application) Run() error {
 			return nil
 		}
 		//в консольном режиме обойдемся без grpc
-		result, err := calc.Calc(text)
-		if err != nil {
+		result, err := a.evaluator.EvalWithEnv(text, a.variables)
+		var syntaxErr *calc.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			log.Printf("Calculation failed with error: %v\n%s", err, syntaxErr.Caret())
+		} else if err != nil {
 			log.Println(text, "<-- you've entered \nCalculation failed with error: ", err)
 		} else {
 			log.Println(result)
@@ -74,25 +162,51 @@ func (a *Application) Run() error {
 	}
 }
 
+// RunServer serves the HTTP API. Without calc servers the expressions are
+// computed in-process by COMPUTING_POWER workers.
 func (a *Application) RunServer() error {
-	orchestrator := NewOrchestrator(a.db, a.calculatorClient)
-
-	authService := auth.NewAuthService(a.db)
+	var calculator CalculatorClient = localCalculator{a.evaluator}
+	workers := a.config.ComputingPower
+	if a.calculatorClient != nil {
+		calculator = a.calculatorClient
+		workers *= a.calculatorClient.Servers()
+	} else {
+		log.Println("GRPC_SERVER_ADDRESS is not set, computing in-process")
+	}
+	orchestrator := NewOrchestrator(a.expressions, a.users, calculator)
+	if a.config.WebhookSecret != "" {
+		orchestrator.EnableWebhooks(webhook.NewSender(a.config.WebhookSecret))
+	}
+	if a.config.AgentToken != "" {
+		orchestrator.AcceptAgents(a.config.AgentToken)
+	} else {
+		log.Println("AGENT_TOKEN is not set, agents are disabled")
+	}
+	orchestrator.StartWorkers(context.Background(), workers)
+	if err := orchestrator.StartJobs(context.Background(), a.config.ComputingPower, a.config.QueueCapacity); err != nil {
+		return err
+	}
 
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/api/v1/register", orchestrator.RegisterHandler)
 	mux.HandleFunc("/api/v1/login", orchestrator.LoginHandler)
+	mux.HandleFunc("/internal/task", orchestrator.InternalTaskHandler)
+	mux.HandleFunc("/api/v1/ws", orchestrator.WebSocketHandler)
 
 	protectedMux := http.NewServeMux()
 	protectedMux.HandleFunc("/api/v1/calculate", orchestrator.CreateExpressionHandler)
+	protectedMux.HandleFunc("/api/v1/calculate/batch", orchestrator.CreateBatchHandler)
 	protectedMux.HandleFunc("/api/v1/expressions", orchestrator.GetExpressionsHandler)
 	protectedMux.HandleFunc("/api/v1/expressions/{id}", orchestrator.ExpressionFromID)
+	protectedMux.HandleFunc("GET /api/v1/expressions/stream", orchestrator.StreamHandler)
+	protectedMux.HandleFunc("DELETE /api/v1/expressions/{id}", orchestrator.CancelExpressionHandler)
 
-	authMiddleware := middleware.AuthMiddleware(authService)
+	authMiddleware := middleware.AuthMiddleware(orchestrator.authService)
 	protectedHandler := authMiddleware(protectedMux)
 
 	mux.Handle("/api/v1/calculate", protectedHandler)
+	mux.Handle("/api/v1/calculate/batch", protectedHandler)
 	mux.Handle("/api/v1/expressions", protectedHandler)
 	mux.Handle("/api/v1/expressions/{id}", protectedHandler)
 
@@ -100,3 +214,19 @@ func (a *Application) RunServer() error {
 	log.Printf("HTTP server listening on %s", serverAddr)
 	return http.ListenAndServe(serverAddr, mux)
 }
+
+// RunAgent starts an agent that computes tasks of the orchestrator at
+// ORCHESTRATOR_URL with COMPUTING_POWER workers.
+func RunAgent(config *Config) error {
+	if config.AgentToken == "" {
+		return errors.New("AGENT_TOKEN is not set")
+	}
+	a := agent.New(config.OrchestratorURL, config.AgentToken, config.ComputingPower, calc.NewEvaluator(config.Calc))
+	return a.Run(context.Background())
+}
+
+// RunCalcServer serves the gRPC calculator on GRPC_LISTEN_ADDRESS. It needs
+// neither the database nor the HTTP API.
+func RunCalcServer(config *Config) error {
+	return calcGrpc.StartServer(config.GrpcServerAddr, calc.NewEvaluator(config.Calc))
+}
@@ -0,0 +1,155 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/shzuzu/Go_Calculator/internal/database/repo"
+	"github.com/shzuzu/Go_Calculator/internal/middleware"
+)
+
+const (
+	maxBatchSize = 10000
+	// batchValidators limits concurrent validation calls of one batch
+	batchValidators = 16
+)
+
+// BatchItem is the outcome of one expression of a batch: its ID if it was
+// accepted, otherwise the error and the status it would get on its own.
+type BatchItem struct {
+	Id   string `json:"id,omitempty"`
+	Code int    `json:"code"`
+	*Error
+}
+
+type BatchResponse struct {
+	Results []BatchItem `json:"results"`
+}
+
+// CreateBatchHandler accepts an array of expressions. Each one is validated
+// on its own; the valid ones are stored in one transaction.
+func (o *Orchestrator) CreateBatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Can't complete that method", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	var requests []Request
+	if err := json.NewDecoder(r.Body).Decode(&requests); err != nil {
+		log.Printf("CreateBatchHandler: error decoding request: %v", err)
+		http.Error(w, "", http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Error{Error: "Unprocessable Entity"})
+		return
+	}
+	if len(requests) == 0 || len(requests) > maxBatchSize {
+		http.Error(w, "", http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(Error{Error: fmt.Sprintf("A batch must contain from 1 to %d expressions", maxBatchSize)})
+		return
+	}
+
+	log.Printf("CreateBatchHandler: received %d expressions", len(requests))
+	results := o.submitBatch(userID, requests)
+	for _, item := range results {
+		if item.Code == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+			break
+		}
+	}
+	json.NewEncoder(w).Encode(BatchResponse{Results: results})
+}
+
+// submitBatch validates the requests concurrently, then queues the valid
+// ones while there is room. Results are in the order of requests.
+func (o *Orchestrator) submitBatch(userID int64, requests []Request) []BatchItem {
+	results := make([]BatchItem, len(requests))
+	sem := make(chan struct{}, batchValidators)
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if apiErr := o.checkCallback(requests[i].CallbackURL); apiErr != nil {
+				results[i].Code, results[i].Error = http.StatusUnprocessableEntity, apiErr
+				return
+			}
+			if err := o.calculatorClient.ValidateExpression(requests[i].Expression, requests[i].Variables); err != nil {
+				results[i].Code, results[i].Error = validationError(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	room := len(requests)
+	if o.queueCapacity > 0 {
+		pending, err := o.expressionRepo.CountPendingJobs()
+		if err != nil {
+			return failBatch(results, http.StatusInternalServerError, "Internal server error")
+		}
+		room = max(o.queueCapacity-pending, 0)
+	}
+
+	var accepted []int
+	var expressions []repo.NewExpression
+	for i, item := range results {
+		if item.Error != nil {
+			continue
+		}
+		if len(accepted) == room {
+			results[i].Code = http.StatusServiceUnavailable
+			results[i].Error = &Error{Error: "Too many expressions in queue, try again later"}
+			continue
+		}
+		accepted = append(accepted, i)
+		expressions = append(expressions, repo.NewExpression{Expression: requests[i].Expression, Variables: requests[i].Variables, CallbackURL: requests[i].CallbackURL})
+	}
+	if len(accepted) == 0 {
+		return results
+	}
+
+	ids, err := o.expressionRepo.CreateBatch(userID, expressions)
+	if err != nil {
+		log.Printf("submitBatch: error creating expressions: %v", err)
+		return failBatch(results, http.StatusInternalServerError, "Internal server error")
+	}
+	for n, i := range accepted {
+		results[i].Id = strconv.FormatInt(ids[n], 10)
+		results[i].Code = http.StatusCreated
+	}
+	log.Printf("submitBatch: accepted %d of %d expressions", len(accepted), len(requests))
+
+	o.events.Notify(userID)
+	// разбудить столько воркеров, сколько новых заданий
+	for range accepted {
+		o.notifyJobs()
+	}
+	return results
+}
+
+// failBatch reports err for every item that passed validation.
+func failBatch(results []BatchItem, code int, message string) []BatchItem {
+	for i := range results {
+		if results[i].Error == nil {
+			results[i].Code = code
+			results[i].Error = &Error{Error: message}
+		}
+	}
+	return results
+}
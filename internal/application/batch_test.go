@@ -0,0 +1,64 @@
+package application_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shzuzu/Go_Calculator/internal/application"
+)
+
+func TestCreateBatchHandler(t *testing.T) {
+	orchestrator, _ := newTestOrchestrator()
+	// очередь на два выражения без воркеров: третье валидное уже не влезет
+	startJobs(t, orchestrator, 0, 2)
+
+	body := `[{"expression":"1+1"},{"expression":"2+*"},{"expression":"3*3"},{"expression":"r = 3"},{"expression":"4+4"}]`
+	rr := httptest.NewRecorder()
+	orchestrator.CreateBatchHandler(rr, newRequest(http.MethodPost, "/api/v1/calculate/batch", body, 1))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	if rr.Header().Get("Retry-After") != "5" {
+		t.Fatalf("Expected Retry-After 5, got %q", rr.Header().Get("Retry-After"))
+	}
+	var response application.BatchResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	expected := []struct {
+		id   string
+		code int
+	}{
+		{"1", http.StatusCreated},
+		{"", http.StatusUnprocessableEntity},
+		{"2", http.StatusCreated},
+		{"", http.StatusUnprocessableEntity},
+		{"", http.StatusServiceUnavailable},
+	}
+	if len(response.Results) != len(expected) {
+		t.Fatalf("Expected %d results, got %d: %s", len(expected), len(response.Results), rr.Body)
+	}
+	for i, item := range response.Results {
+		if item.Id != expected[i].id || item.Code != expected[i].code || (item.Id == "") != (item.Error != nil) {
+			t.Fatalf("Result %d: expected id %q and code %d, got %+v", i, expected[i].id, expected[i].code, item)
+		}
+	}
+	if response.Results[1].Position == nil {
+		t.Fatalf("Expected the position of the syntax error, got %+v", response.Results[1].Error)
+	}
+}
+
+func TestCreateBatchHandlerRejectsEmptyBatch(t *testing.T) {
+	orchestrator, _ := newTestOrchestrator()
+	rr := httptest.NewRecorder()
+
+	orchestrator.CreateBatchHandler(rr, newRequest(http.MethodPost, "/api/v1/calculate/batch", `[]`, 1))
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+}
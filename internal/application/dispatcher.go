@@ -0,0 +1,161 @@
+package application
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/agent"
+)
+
+// dispatchedTask is a ready operation waiting for an executor: either an
+// in-process worker calling the gRPC calculator or a remote agent.
+type dispatchedTask struct {
+	agent.Task
+	step    int
+	ctx     context.Context
+	results chan<- stepResult
+	// leaseExpires is set when the task is handed out
+	leaseExpires time.Time
+}
+
+// taskLease is how long an executor may hold a task before it is handed
+// out again, e.g. because the agent holding it died.
+const taskLease = time.Minute
+
+// dispatcher is the queue of ready tasks shared by all executors. A task is
+// handed out once; its result is delivered to the plan that submitted it.
+type dispatcher struct {
+	mu       sync.Mutex
+	queue    []*dispatchedTask
+	inFlight map[int64]*dispatchedTask
+	// wait is closed and replaced whenever a task is queued
+	wait chan struct{}
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{
+		inFlight: make(map[int64]*dispatchedTask),
+		wait:     make(chan struct{}),
+	}
+}
+
+func (d *dispatcher) Submit(task *dispatchedTask) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queue = append(d.queue, task)
+	close(d.wait)
+	d.wait = make(chan struct{})
+}
+
+// TryNext hands out the oldest queued task without blocking.
+func (d *dispatcher) TryNext() (*dispatchedTask, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	task := d.popLocked()
+	return task, task != nil
+}
+
+// Next blocks until a task is queued or ctx is done.
+func (d *dispatcher) Next(ctx context.Context) (*dispatchedTask, error) {
+	for {
+		d.mu.Lock()
+		task := d.popLocked()
+		wait := d.wait
+		d.mu.Unlock()
+		if task != nil {
+			return task, nil
+		}
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (d *dispatcher) popLocked() *dispatchedTask {
+	if len(d.queue) == 0 {
+		return nil
+	}
+	task := d.queue[0]
+	d.queue[0] = nil
+	d.queue = d.queue[1:]
+	task.leaseExpires = time.Now().Add(taskLease)
+	d.inFlight[task.ID] = task
+	return task
+}
+
+// RequeueExpired puts handed out tasks whose lease has expired back at the
+// front of the queue and returns their IDs.
+func (d *dispatcher) RequeueExpired(now time.Time) []int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var expired []*dispatchedTask
+	for id, task := range d.inFlight {
+		if now.After(task.leaseExpires) {
+			delete(d.inFlight, id)
+			expired = append(expired, task)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(expired))
+	for i, task := range expired {
+		ids[i] = task.ID
+	}
+	d.queue = append(expired, d.queue...)
+	close(d.wait)
+	d.wait = make(chan struct{})
+	return ids
+}
+
+// Complete delivers the result of a handed out task. It reports false if the
+// task is unknown, e.g. because it was cancelled in the meantime.
+func (d *dispatcher) Complete(id int64, value float64, err error) bool {
+	d.mu.Lock()
+	task, ok := d.inFlight[id]
+	delete(d.inFlight, id)
+	d.mu.Unlock()
+	if !ok {
+		return false
+	}
+	task.results <- stepResult{step: task.step, value: value, err: err}
+	return true
+}
+
+// Cancel withdraws the given tasks, queued or handed out, and returns the
+// IDs it removed. Results for them are no longer delivered.
+func (d *dispatcher) Cancel(ids []int64) []int64 {
+	set := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var removed []int64
+	queue := d.queue[:0]
+	for _, task := range d.queue {
+		if set[task.ID] {
+			removed = append(removed, task.ID)
+			continue
+		}
+		queue = append(queue, task)
+	}
+	for i := len(queue); i < len(d.queue); i++ {
+		d.queue[i] = nil
+	}
+	d.queue = queue
+
+	for _, id := range ids {
+		if _, ok := d.inFlight[id]; ok {
+			delete(d.inFlight, id)
+			removed = append(removed, id)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,165 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/middleware"
+)
+
+const (
+	// streamHeartbeat keeps idle streams alive behind proxies
+	streamHeartbeat = 15 * time.Second
+	// eventPollInterval is how often events of other orchestrators are
+	// looked for
+	eventPollInterval = time.Second
+)
+
+// eventHub wakes up subscribers when an expression of their user changed.
+// The events themselves are read from the database, so a wakeup carries no
+// data and may be coalesced.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[int64]map[chan struct{}]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[int64]map[chan struct{}]struct{})}
+}
+
+// Subscribe returns a channel that receives a value after new events of
+// the user were recorded, and a function to unsubscribe.
+func (h *eventHub) Subscribe(userID int64) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[chan struct{}]struct{})
+	}
+	h.subs[userID][ch] = struct{}{}
+
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs[userID], ch)
+		if len(h.subs[userID]) == 0 {
+			delete(h.subs, userID)
+		}
+	}
+}
+
+func (h *eventHub) Notify(userID int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[userID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watchEvents wakes up local subscribers for events recorded by other
+// orchestrators sharing the database. Events of this process are notified
+// directly; a second wakeup for them is harmless.
+func (o *Orchestrator) watchEvents(ctx context.Context) {
+	_, last, err := o.expressionRepo.UsersWithEventsAfter(0)
+	if err != nil {
+		log.Printf("watchEvents: failed to read events: %v", err)
+	}
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			users, next, err := o.expressionRepo.UsersWithEventsAfter(last)
+			if err != nil {
+				continue
+			}
+			last = next
+			for _, userID := range users {
+				o.events.Notify(userID)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// StreamHandler sends the caller's expression status changes as
+// Server-Sent Events. A client that reconnects with Last-Event-ID gets the
+// events it missed.
+func (o *Orchestrator) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// подписываемся до чтения курсора, чтобы не пропустить событие между ними
+	wakeup, unsubscribe := o.events.Subscribe(userID)
+	defer unsubscribe()
+
+	var lastID int64
+	var err error
+	if cursor := r.Header.Get("Last-Event-ID"); cursor != "" {
+		lastID, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	} else {
+		lastID, err = o.expressionRepo.LastEventID(userID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	log.Printf("StreamHandler: user %d subscribed after event %d", userID, lastID)
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		events, err := o.expressionRepo.GetEventsAfter(userID, lastID)
+		if err != nil {
+			return
+		}
+		for _, event := range events {
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %d\nevent: status\ndata: %s\n\n", event.ID, data)
+			lastID = event.ID
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+		}
+
+		select {
+		case <-wakeup:
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			log.Printf("StreamHandler: user %d disconnected", userID)
+			return
+		}
+	}
+}
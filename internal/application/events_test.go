@@ -0,0 +1,135 @@
+package application_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/application"
+	"github.com/shzuzu/Go_Calculator/internal/database/repo"
+	"github.com/shzuzu/Go_Calculator/internal/middleware"
+)
+
+type sseEvent struct {
+	id   string
+	expr repo.Expression
+}
+
+// readEvents parses Server-Sent Events from body until it is closed.
+func readEvents(body io.Reader) <-chan sseEvent {
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(body)
+		var event sseEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.expr)
+			case line == "" && event.id != "":
+				events <- event
+				event = sseEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("Stream closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+	}
+	return sseEvent{}
+}
+
+// openStream connects to the stream of user 1, resuming after lastEventID
+// unless it is empty.
+func openStream(t *testing.T, server *httptest.Server, lastEventID string) (<-chan sseEvent, func()) {
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response: %s %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	return readEvents(resp.Body), func() { resp.Body.Close() }
+}
+
+func submit(t *testing.T, orchestrator *application.Orchestrator, expression string) {
+	rr := httptest.NewRecorder()
+	orchestrator.CreateExpressionHandler(rr, newRequest(http.MethodPost, "/api/v1/calculate", `{"expression":"`+expression+`"}`, 1))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, but got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+}
+
+func TestStreamHandlerReplaysMissedEvents(t *testing.T) {
+	orchestrator, _ := newTestOrchestrator()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		orchestrator.StreamHandler(w, r.WithContext(context.WithValue(r.Context(), middleware.UserIDKey, int64(1))))
+	}))
+	defer server.Close()
+
+	// без Last-Event-ID поток начинается с новых событий
+	submit(t, orchestrator, "1+1")
+	events, disconnect := openStream(t, server, "")
+	submit(t, orchestrator, "2+2")
+	first := nextEvent(t, events)
+	if first.expr.ID != "2" || first.expr.Status != "pending" {
+		t.Fatalf("Expected pending expression 2, got %+v", first)
+	}
+	disconnect()
+
+	// пока клиент отключен, выражение отменяют и создают новое
+	req := newRequest(http.MethodDelete, "/api/v1/expressions/2", "", 1)
+	req.SetPathValue("id", "2")
+	orchestrator.CancelExpressionHandler(httptest.NewRecorder(), req)
+	submit(t, orchestrator, "3+3")
+
+	events, disconnect = openStream(t, server, first.id)
+	defer disconnect()
+	missed := []sseEvent{nextEvent(t, events), nextEvent(t, events)}
+	if missed[0].expr.ID != "2" || missed[0].expr.Status != "cancelled" ||
+		missed[1].expr.ID != "3" || missed[1].expr.Status != "pending" {
+		t.Fatalf("Expected cancelled 2 and pending 3, got %+v", missed)
+	}
+
+	// после пропущенных событий поток продолжается без повторов
+	submit(t, orchestrator, "4+4")
+	if next := nextEvent(t, events); next.expr.ID != "4" {
+		t.Fatalf("Expected expression 4 after the replay, got %+v", next)
+	}
+}
+
+func TestStreamHandlerRejectsInvalidLastEventID(t *testing.T) {
+	orchestrator, _ := newTestOrchestrator()
+	req := newRequest(http.MethodGet, "/api/v1/expressions/stream", "", 1)
+	req.Header.Set("Last-Event-ID", "abc")
+	rr := httptest.NewRecorder()
+
+	orchestrator.StreamHandler(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusBadRequest, rr.Code)
+	}
+}
@@ -0,0 +1,72 @@
+package application
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/database/repo"
+)
+
+const (
+	// idempotencyTTL is how long a retried request returns the original
+	// expression
+	idempotencyTTL          = 24 * time.Hour
+	maxIdempotencyKeyLength = 255
+)
+
+// requestHash identifies the body of a request. Variables are encoded with
+// sorted keys, so the order of fields does not matter.
+func requestHash(request *Request) string {
+	data, _ := json.Marshal(request)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// replayIdempotent looks up an earlier request of the user with the same
+// key. It reports found = false if the key is new; a key used with another
+// body is an error.
+func (o *Orchestrator) replayIdempotent(userID int64, key, hash string) (id int64, found bool, code int, apiErr *Error) {
+	k, err := o.expressionRepo.GetIdempotencyKey(userID, key)
+	if err != nil {
+		return 0, false, http.StatusInternalServerError, &Error{Error: "Internal server error"}
+	}
+	if k == nil {
+		return 0, false, 0, nil
+	}
+	if k.RequestHash != hash {
+		return 0, true, http.StatusUnprocessableEntity, &Error{Error: "Idempotency-Key was already used with a different request"}
+	}
+	log.Printf("replayIdempotent: key %q of user %d already created expression %d", key, userID, k.ExpressionID)
+	return k.ExpressionID, true, http.StatusCreated, nil
+}
+
+// createExpression stores the expression with its job, remembering the
+// idempotency key if there is one.
+func (o *Orchestrator) createExpression(userID int64, request *Request, key, hash string) (int64, error) {
+	if key == "" {
+		return o.expressionRepo.CreateWithJob(userID, request.Expression, request.Variables, request.CallbackURL)
+	}
+	return o.expressionRepo.CreateIdempotent(userID,
+		repo.NewExpression{Expression: request.Expression, Variables: request.Variables, CallbackURL: request.CallbackURL},
+		&repo.IdempotencyKey{Key: key, RequestHash: hash, ExpiresAt: time.Now().Add(idempotencyTTL)})
+}
+
+func (o *Orchestrator) purgeIdempotencyKeys(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if n, err := o.expressionRepo.DeleteExpiredIdempotencyKeys(now); err == nil && n > 0 {
+				log.Printf("purgeIdempotencyKeys: removed %d expired keys", n)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
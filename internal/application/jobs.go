@@ -0,0 +1,225 @@
+package application
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/database/repo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// jobLease is how long a claimed job stays ours without being renewed
+	jobLease = 30 * time.Second
+	// leaseRenewInterval is also how soon a worker notices that another
+	// replica cancelled its expression: the cancel releases the lease
+	leaseRenewInterval = 2 * time.Second
+	jobPollInterval    = 500 * time.Millisecond
+	maxJobAttempts     = 5
+	retryBaseDelay     = time.Second
+	retryMaxDelay      = time.Minute
+)
+
+// retryAfter is sent to clients whose expression was rejected because the
+// queue is full.
+const retryAfter = 5 * time.Second
+
+// StartJobs releases the jobs left by a previous run and runs the workers
+// and housekeeping loops until ctx is done. At most capacity jobs may wait
+// for a free worker; further submissions are rejected.
+func (o *Orchestrator) StartJobs(ctx context.Context, workers, capacity int) error {
+	o.mu.Lock()
+	o.queueCapacity = capacity
+	o.jobsReady = make(chan struct{}, workers)
+	o.mu.Unlock()
+
+	n, err := o.expressionRepo.RecoverJobs()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("Orchestrator: picking up %d unfinished jobs", n)
+	}
+	log.Printf("Orchestrator: starting %d job workers, queue capacity %d", workers, capacity)
+	for i := 0; i < workers; i++ {
+		go o.jobWorker(ctx)
+	}
+	if o.webhooks != nil {
+		for i := 0; i < callbackWorkers; i++ {
+			go o.callbackWorker(ctx)
+		}
+	}
+	go o.requeueExpiredTasks(ctx)
+	go o.purgeIdempotencyKeys(ctx)
+	go o.watchEvents(ctx)
+	return nil
+}
+
+func (o *Orchestrator) requeueExpiredTasks(ctx context.Context) {
+	ticker := time.NewTicker(taskLease / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, id := range o.dispatcher.RequeueExpired(now) {
+				log.Printf("requeueExpiredTasks: lease of task %d expired, handing it out again", id)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// notifyJobs wakes up the job loop after a new job was stored.
+func (o *Orchestrator) notifyJobs() {
+	select {
+	case o.jobsReady <- struct{}{}:
+	default:
+	}
+}
+
+// acceptJob reports whether the queue has room for one more job.
+func (o *Orchestrator) acceptJob() (bool, error) {
+	if o.queueCapacity <= 0 {
+		return true, nil
+	}
+	n, err := o.expressionRepo.CountPendingJobs()
+	if err != nil {
+		return false, err
+	}
+	return n < o.queueCapacity, nil
+}
+
+// jobWorker claims and evaluates one job at a time.
+func (o *Orchestrator) jobWorker(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := o.expressionRepo.ClaimJob(jobLease)
+		if err != nil {
+			log.Printf("jobWorker: failed to claim job: %v", err)
+		}
+		if job != nil {
+			o.events.Notify(job.UserID)
+			o.runJob(ctx, job)
+			continue
+		}
+
+		select {
+		case <-o.jobsReady:
+		case <-time.After(jobPollInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// runJob evaluates the expression of a claimed job. Failures of the calc
+// servers are retried with exponential backoff, calculation errors are
+// final.
+func (o *Orchestrator) runJob(ctx context.Context, job *repo.Job) {
+	id := job.ExpressionID
+	log.Printf("runJob: calculating expression %d (attempt %d): %s", id, job.Attempts, job.Expression)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	o.mu.Lock()
+	o.running[id] = cancel
+	o.mu.Unlock()
+	defer func() {
+		o.mu.Lock()
+		delete(o.running, id)
+		o.mu.Unlock()
+	}()
+
+	go o.renewLease(ctx, cancel, job)
+	result, err := o.runExpression(ctx, id, &Request{Expression: job.Expression, Variables: job.Variables})
+
+	// задание могли отменить, пока оно считалось: тогда статус уже "cancelled"
+	switch {
+	case ctx.Err() != nil:
+		log.Printf("runJob: evaluation of expression %d stopped: %v", id, ctx.Err())
+	case err == nil:
+		log.Printf("runJob: calculation result for expression %d: %v", id, result)
+		if ok, _ := o.expressionRepo.CompleteJob(job.ID, job.LeaseToken, &result, ""); ok {
+			o.events.Notify(job.UserID)
+			if job.CallbackURL != "" {
+				o.notifyCallbacks()
+			}
+		}
+	case retryable(err) && job.Attempts < maxJobAttempts:
+		delay := retryDelay(job.Attempts)
+		log.Printf("runJob: expression %d failed, retrying in %v: %v", id, delay, err)
+		if ok, _ := o.expressionRepo.RetryJob(job.ID, job.LeaseToken, time.Now().Add(delay), err.Error()); ok {
+			o.setStatus(job, "pending", nil)
+		}
+	default:
+		log.Printf("runJob: calculation error for expression %d: %v", id, err)
+		if ok, _ := o.expressionRepo.CompleteJob(job.ID, job.LeaseToken, nil, errorMessage(err)); ok {
+			o.events.Notify(job.UserID)
+			if job.CallbackURL != "" {
+				o.notifyCallbacks()
+			}
+		}
+	}
+}
+
+func (o *Orchestrator) setStatus(job *repo.Job, status string, result *float64) {
+	if err := o.expressionRepo.UpdateStatus(job.ExpressionID, status, result); err == nil {
+		o.events.Notify(job.UserID)
+	}
+}
+
+// cancelJob stops the evaluation of an expression if it is running here.
+func (o *Orchestrator) cancelJob(id int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if cancel, ok := o.running[id]; ok {
+		log.Printf("cancelJob: cancelling expression %d", id)
+		cancel()
+	}
+}
+
+// renewLease keeps the lease of a running job and calls cancel once the
+// lease is lost, e.g. because the expression was cancelled on another
+// replica: the result of the evaluation could not be stored anyway.
+func (o *Orchestrator) renewLease(ctx context.Context, cancel context.CancelFunc, job *repo.Job) {
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// ошибку базы пережидаем: аренда еще действует
+			if ok, err := o.expressionRepo.RenewLease(job.ID, job.LeaseToken, jobLease); err == nil && !ok {
+				log.Printf("renewLease: lease of job %d is lost, stopping expression %d", job.ID, job.ExpressionID)
+				cancel()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// retryable reports whether err is a transient failure of a calc server.
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// retryDelay doubles with every attempt up to retryMaxDelay.
+func retryDelay(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMaxDelay)
+}
+
+// errorMessage is the reason of a failed evaluation shown to the user,
+// without the gRPC status prefix.
+func errorMessage(err error) string {
+	return status.Convert(err).Message()
+}
@@ -1,23 +1,31 @@
 package application
 
 import (
-	"database/sql"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/shzuzu/Go_Calculator/internal/agent"
 	"github.com/shzuzu/Go_Calculator/internal/auth"
 	"github.com/shzuzu/Go_Calculator/internal/database/repo"
 	"github.com/shzuzu/Go_Calculator/internal/grpc"
 	"github.com/shzuzu/Go_Calculator/internal/middleware"
+	"github.com/shzuzu/Go_Calculator/internal/webhook"
 	"github.com/shzuzu/Go_Calculator/pkg/calc"
 )
 
 type Request struct {
-	Expression string `json:"expression"`
+	Expression string             `json:"expression"`
+	Variables  map[string]float64 `json:"variables,omitempty"`
+	// CallbackURL receives the finished expression as a signed POST
+	CallbackURL string `json:"callback_url,omitempty"`
 }
 
 type LoginRequest struct {
@@ -35,20 +43,65 @@ type Token struct {
 
 type Error struct {
 	Error string `json:"error"`
+	// Заполняются только для синтаксических ошибок
+	Position   *int   `json:"position,omitempty"`
+	Token      string `json:"token,omitempty"`
+	Expected   string `json:"expected,omitempty"`
+	Diagnostic string `json:"diagnostic,omitempty"`
+}
+
+// CalculatorClient validates expressions and computes single operations
+// for the orchestrator. *grpc.CalculatorClient talks to the calc servers,
+// localCalculator computes in-process; tests may use a fake.
+type CalculatorClient interface {
+	ValidateExpression(expression string, variables map[string]float64) error
+	Compute(ctx context.Context, operation string, args []float64) (float64, error)
+}
+
+var _ CalculatorClient = (*grpc.CalculatorClient)(nil)
+
+// localCalculator is used when no calc server is configured.
+type localCalculator struct {
+	evaluator *calc.Evaluator
+}
+
+func (c localCalculator) ValidateExpression(expression string, variables map[string]float64) error {
+	return calc.Validate(expression, variables)
+}
+
+func (c localCalculator) Compute(ctx context.Context, operation string, args []float64) (float64, error) {
+	return c.evaluator.Apply(ctx, operation, args)
 }
 
 type Orchestrator struct {
 	mu               sync.Mutex
-	expressionRepo   *repo.Repository
+	expressionRepo   repo.ExpressionStore
 	authService      *auth.AuthService
-	calculatorClient *grpc.CalculatorClient
+	calculatorClient CalculatorClient
+	dispatcher       *dispatcher
+	jobsReady        chan struct{}
+	callbacksReady   chan struct{}
+	queueCapacity    int
+	// running holds the cancel functions of jobs evaluated right now
+	running map[int64]context.CancelFunc
+	events  *eventHub
+	// webhooks is nil when no WEBHOOK_SECRET is configured
+	webhooks *webhook.Sender
+	// agentToken is the AGENT_TOKEN agents must present; without it
+	// /internal/task rejects every request
+	agentToken string
 }
 
-func NewOrchestrator(db *sql.DB, calcClient *grpc.CalculatorClient) *Orchestrator {
+func NewOrchestrator(expressions repo.ExpressionStore, users auth.UserStore, calcClient CalculatorClient) *Orchestrator {
 	return &Orchestrator{
-		expressionRepo:   repo.NewRepository(db),
-		authService:      auth.NewAuthService(db),
+		expressionRepo:   expressions,
+		authService:      auth.NewAuthService(users),
 		calculatorClient: calcClient,
+		dispatcher:       newDispatcher(),
+		jobsReady:        make(chan struct{}, 1),
+		callbacksReady:   make(chan struct{}, 1),
+		running:          make(map[int64]context.CancelFunc),
+		events:           newEventHub(),
 	}
 }
 
@@ -134,17 +187,39 @@ func (o *Orchestrator) GetExpressionsHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	expressions, err := o.expressionRepo.GetByUserID(userID)
+	query, err := parseExpressionQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Error{Error: err.Error()})
+		return
+	}
+
+	// берем на одно выражение больше, чтобы узнать, есть ли следующая страница
+	limit := query.Limit
+	query.Limit++
+	expressions, err := o.expressionRepo.ListExpressions(userID, query)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	if err := json.NewEncoder(w).Encode(expressions); err != nil {
+
+	page := ExpressionsPage{Expressions: expressions}
+	if len(expressions) > limit {
+		page.Expressions = expressions[:limit]
+		page.NextCursor = page.Expressions[limit-1].ID
+	}
+	if page.Expressions == nil {
+		page.Expressions = []*repo.Expression{}
+	}
+	if err := json.NewEncoder(w).Encode(page); err != nil {
 		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
 		return
 	}
 
 }
+
+// ExpressionFromID returns an expression of the caller. With ?wait=30s it
+// blocks until the expression is finished or the timeout expires.
 func (o *Orchestrator) ExpressionFromID(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -161,21 +236,130 @@ func (o *Orchestrator) ExpressionFromID(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	expr, err := o.expressionRepo.GetByID(id)
+	wait, err := parseWait(r.URL.Query().Get("wait"))
 	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		http.Error(w, "Invalid wait", http.StatusBadRequest)
 		return
 	}
 
-	if expr == nil || expr.UserID != userID {
-		http.Error(w, fmt.Sprintf("Expression with ID %s not found", idStr), http.StatusNotFound)
+	// подписка до первого чтения, чтобы не пропустить изменение статуса
+	var wakeup <-chan struct{}
+	if wait > 0 {
+		var unsubscribe func()
+		wakeup, unsubscribe = o.events.Subscribe(userID)
+		defer unsubscribe()
+	}
+	timeout := time.After(wait)
+
+	for {
+		expr, err := o.expressionRepo.GetByID(id)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if expr == nil || expr.UserID != userID {
+			http.Error(w, fmt.Sprintf("Expression with ID %s not found", idStr), http.StatusNotFound)
+			return
+		}
+
+		if wait > 0 && !finished(expr.Status) {
+			select {
+			case <-wakeup:
+				continue
+			case <-timeout:
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if err := json.NewEncoder(w).Encode(expr); err != nil {
+			http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+			return
+		}
 		return
 	}
+}
 
-	if err := json.NewEncoder(w).Encode(expr); err != nil {
-		http.Error(w, "Something went wrong..", http.StatusInternalServerError)
+// maxWait limits how long ExpressionFromID may block.
+const maxWait = 2 * time.Minute
+
+// parseWait accepts a duration like "30s" or a number of seconds.
+func parseWait(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return 0, err
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 {
+		return 0, fmt.Errorf("negative wait %v", wait)
+	}
+	return min(wait, maxWait), nil
+}
+
+func finished(status string) bool {
+	return status == "done" || status == "error" || status == "cancelled"
+}
+
+// CancelExpressionHandler stops an expression that is not finished yet.
+// Finished expressions get 409.
+func (o *Orchestrator) CancelExpressionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID, ok := middleware.GetUserID(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	idStr := r.PathValue("id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	expr, code, apiErr := o.cancelExpression(userID, id)
+	if apiErr != nil {
+		http.Error(w, "", code)
+		json.NewEncoder(w).Encode(apiErr)
 		return
 	}
+	json.NewEncoder(w).Encode(expr)
+}
+
+// cancelExpression cancels an expression of the user. On failure it
+// returns the HTTP status and the error to report.
+func (o *Orchestrator) cancelExpression(userID, id int64) (*repo.Expression, int, *Error) {
+	expr, err := o.expressionRepo.GetByID(id)
+	if err != nil {
+		return nil, http.StatusInternalServerError, &Error{Error: "Internal server error"}
+	}
+	if expr == nil || expr.UserID != userID {
+		return nil, http.StatusNotFound, &Error{Error: fmt.Sprintf("Expression with ID %d not found", id)}
+	}
+
+	cancelled, err := o.expressionRepo.CancelExpression(id)
+	if err != nil {
+		return nil, http.StatusInternalServerError, &Error{Error: "Internal server error"}
+	}
+	if !cancelled {
+		return nil, http.StatusConflict, &Error{Error: "Expression is already finished"}
+	}
+	o.cancelJob(id)
+	o.events.Notify(userID)
+	// об отмене сообщаем колбэком так же, как о результате
+	o.notifyCallbacks()
+	log.Printf("cancelExpression: expression %d cancelled", id)
+
+	expr.Status = "cancelled"
+	return expr, http.StatusOK, nil
 }
 
 func (o *Orchestrator) CreateExpressionHandler(w http.ResponseWriter, r *http.Request) {
@@ -206,49 +390,173 @@ func (o *Orchestrator) CreateExpressionHandler(w http.ResponseWriter, r *http.Re
 
 	log.Printf("CreateExpressionHandler: received expression: %s", request.Expression)
 
-	if err := o.calculatorClient.ValidateExpression(request.Expression); err != nil {
-		log.Printf("CreateExpressionHandler: error validating expression: %v", err)
-		switch err {
-		case calc.ErrInvalidExpression:
-			http.Error(w, "", http.StatusUnprocessableEntity)
-			json.NewEncoder(w).Encode(Error{Error: "Expression is not valid"})
-			return
-		case calc.ErrDivisionByZero:
-			http.Error(w, "", http.StatusUnprocessableEntity)
-			json.NewEncoder(w).Encode(Error{Error: "Division by zero"})
-			return
-		case calc.ErrEOF:
-			http.Error(w, "", http.StatusUnprocessableEntity)
-			json.NewEncoder(w).Encode(Error{Error: "You should enter an expression"})
-			return
-		default:
-			http.Error(w, "", http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(Error{Error: "Internal server error"})
-			return
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKeyLength {
+		http.Error(w, "", http.StatusBadRequest)
+		json.NewEncoder(w).Encode(Error{Error: "Idempotency-Key is too long"})
+		return
+	}
+
+	id, code, apiErr := o.submitExpression(userID, request, key)
+	if apiErr != nil {
+		if code == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		}
+		http.Error(w, "", code)
+		json.NewEncoder(w).Encode(apiErr)
+		return
+	}
+
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(Id{Id: strconv.FormatInt(id, 10)})
+}
+
+// submitExpression validates an expression of the user and queues it for
+// evaluation. A request repeated with the same idempotency key returns the
+// expression created the first time. On failure it returns the HTTP status
+// and the error to report.
+func (o *Orchestrator) submitExpression(userID int64, request *Request, idempotencyKey string) (int64, int, *Error) {
+	var hash string
+	if idempotencyKey != "" {
+		hash = requestHash(request)
+		if id, found, code, apiErr := o.replayIdempotent(userID, idempotencyKey, hash); found || apiErr != nil {
+			return id, code, apiErr
 		}
 	}
 
-	id, err := o.expressionRepo.Create(userID, request.Expression)
+	if apiErr := o.checkCallback(request.CallbackURL); apiErr != nil {
+		return 0, http.StatusUnprocessableEntity, apiErr
+	}
+	if err := o.calculatorClient.ValidateExpression(request.Expression, request.Variables); err != nil {
+		log.Printf("submitExpression: error validating expression: %v", err)
+		code, apiErr := validationError(err)
+		return 0, code, apiErr
+	}
+
+	// проверка очереди и создание задания под одним мьютексом, чтобы
+	// параллельные запросы не превысили емкость
+	o.mu.Lock()
+	if idempotencyKey != "" {
+		// такой же запрос мог успеть создать выражение, пока мы проверяли свое
+		if id, found, code, apiErr := o.replayIdempotent(userID, idempotencyKey, hash); found || apiErr != nil {
+			o.mu.Unlock()
+			return id, code, apiErr
+		}
+	}
+	accepted, err := o.acceptJob()
+	var id int64
+	if err == nil && accepted {
+		id, err = o.createExpression(userID, request, idempotencyKey, hash)
+	}
+	o.mu.Unlock()
+	if err == nil && !accepted {
+		log.Println("submitExpression: queue is full")
+		return 0, http.StatusServiceUnavailable, &Error{Error: "Too many expressions in queue, try again later"}
+	}
 	if err != nil {
-		log.Printf("CreateExpressionHandler: error creating expression: %v", err)
-		http.Error(w, "", http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(Error{Error: "Internal server erro"})
+		log.Printf("submitExpression: error creating expression: %v", err)
+		return 0, http.StatusInternalServerError, &Error{Error: "Internal server erro"}
+	}
+
+	o.events.Notify(userID)
+	o.notifyJobs()
+	return id, http.StatusCreated, nil
+}
+
+// validationError turns an error from expression validation into the HTTP
+// status and the error to report.
+func validationError(err error) (int, *Error) {
+	var syntaxErr *calc.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return http.StatusUnprocessableEntity, &Error{
+			Error:      "Expression is not valid",
+			Position:   &syntaxErr.Offset,
+			Token:      syntaxErr.Token,
+			Expected:   syntaxErr.Expected,
+			Diagnostic: syntaxErr.Caret(),
+		}
+	}
+	var funcErr *calc.FunctionError
+	if errors.As(err, &funcErr) {
+		return http.StatusUnprocessableEntity, &Error{Error: funcErr.Error()}
+	}
+	var nameErr *calc.NameError
+	if errors.As(err, &nameErr) {
+		return http.StatusUnprocessableEntity, &Error{Error: nameErr.Error()}
+	}
+	switch err {
+	case calc.ErrInvalidExpression:
+		return http.StatusUnprocessableEntity, &Error{Error: "Expression is not valid"}
+	case calc.ErrDivisionByZero:
+		return http.StatusUnprocessableEntity, &Error{Error: "Division by zero"}
+	case calc.ErrModuloByZero:
+		return http.StatusUnprocessableEntity, &Error{Error: "Modulo by zero"}
+	case calc.ErrIntDivisionByZero:
+		return http.StatusUnprocessableEntity, &Error{Error: "Integer division by zero"}
+	case calc.ErrEOF:
+		return http.StatusUnprocessableEntity, &Error{Error: "You should enter an expression"}
+	default:
+		return http.StatusInternalServerError, &Error{Error: "Internal server error"}
+	}
+}
+
+// AcceptAgents lets agents that present token take tasks from
+// /internal/task.
+func (o *Orchestrator) AcceptAgents(token string) {
+	o.agentToken = token
+}
+
+// agentAuthorized reports whether the request carries the agent token.
+func (o *Orchestrator) agentAuthorized(r *http.Request) bool {
+	token, ok := middleware.BearerToken(r.Header.Get("Authorization"))
+	return ok && o.agentToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(o.agentToken)) == 1
+}
+
+// InternalTaskHandler serves agents: GET hands out the next ready operation
+// (404 if there is none), POST accepts its result. Both need the agent
+// token, so clients cannot take or forge tasks of other users.
+func (o *Orchestrator) InternalTaskHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !o.agentAuthorized(r) {
+		http.Error(w, "", http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(Error{Error: "Invalid agent token"})
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(Id{Id: strconv.FormatInt(id, 10)})
+	switch r.Method {
+	case http.MethodGet:
+		task, ok := o.dispatcher.TryNext()
+		if !ok {
+			http.Error(w, "", http.StatusNotFound)
+			json.NewEncoder(w).Encode(Error{Error: "No tasks available"})
+			return
+		}
+		log.Printf("InternalTaskHandler: handing out task %d: %s %v", task.ID, task.Operation, task.Args)
+		json.NewEncoder(w).Encode(task.Task)
 
-	go func() {
-		log.Printf("CreateExpressionHandler: calculating expression: %s", request.Expression)
-		result, err := o.calculatorClient.Calculate(request.Expression)
+	case http.MethodPost:
+		defer r.Body.Close()
+		var result agent.TaskResult
+		if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+			http.Error(w, "", http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(Error{Error: "Unprocessable Entity"})
+			return
+		}
 
-		if err != nil {
-			log.Printf("CreateExpressionHandler: calculation error: %v", err)
-			o.expressionRepo.UpdateStatus(id, "error", nil)
-		} else {
-			log.Printf("CreateExpressionHandler: calculation result: %v", result)
-			o.expressionRepo.UpdateStatus(id, "done", &result)
+		var taskErr error
+		if result.Error != "" {
+			taskErr = errors.New(result.Error)
+		}
+		if !o.dispatcher.Complete(result.ID, result.Result, taskErr) {
+			http.Error(w, "", http.StatusNotFound)
+			json.NewEncoder(w).Encode(Error{Error: fmt.Sprintf("Task with ID %d not found", result.ID)})
+			return
 		}
-	}()
+		log.Printf("InternalTaskHandler: received result of task %d", result.ID)
+		json.NewEncoder(w).Encode(map[string]string{"status": "OK"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
 }
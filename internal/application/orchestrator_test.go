@@ -1,170 +1,437 @@
 package application_test
 
-// import (
-// 	"bytes"
-// 	"encoding/json"
-// 	"net/http"
-// 	"net/http/httptest"
-// 	"reflect"
-// 	"strings"
-// 	"testing"
-
-// 	"github.com/shzuzu/Go_Calculator/internal/application"
-// )
-
-// func TestCreateExpressionHandler(t *testing.T) {
-// 	orchestrator := application.NewOrchestrator(4)
-
-// 	tt := []struct {
-// 		name           string
-// 		expression     string
-// 		expectedStatus int
-// 		expectedBody   []byte
-// 	}{
-// 		{
-// 			name:           "Valid Expression",
-// 			expression:     "2+2*2",
-// 			expectedStatus: http.StatusCreated,
-// 			expectedBody:   []byte(`{"id":"1"}`),
-// 		},
-// 		{
-// 			name:           "Invalid Expression",
-// 			expression:     "2(+()",
-// 			expectedStatus: http.StatusUnprocessableEntity,
-// 			expectedBody:   []byte(`{"error":"Expression is not valid"}`),
-// 		},
-// 		{
-// 			name:           "Division by Zero",
-// 			expression:     "1/0",
-// 			expectedStatus: http.StatusUnprocessableEntity,
-// 			expectedBody:   []byte(`{"error":"Division by zero"}`),
-// 		},
-// 	}
-
-// 	for _, tc := range tt {
-// 		t.Run(tc.name, func(t *testing.T) {
-// 			requestBody, _ := json.Marshal(map[string]string{"expression": tc.expression})
-// 			req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", bytes.NewReader(requestBody))
-// 			req.Header.Set("Content-Type", "application/json")
-
-// 			rr := httptest.NewRecorder()
-
-// 			orchestrator.CreateExpressionHandler(rr, req)
-
-// 			if rr.Code != tc.expectedStatus {
-// 				t.Errorf("Expected status code %d, but got %d", tc.expectedStatus, rr.Code)
-// 			}
-
-// 			if !JSONBytesEqual(rr.Body.Bytes(), tc.expectedBody) {
-// 				t.Errorf("Expected body %s, but got %s", string(tc.expectedBody), rr.Body.String())
-// 			}
-// 		})
-// 	}
-// }
-
-// func TestGetExpressionsHandler(t *testing.T) {
-// 	orchestrator := application.NewOrchestrator(4)
-// 	orchestrator.Exprs = []application.Expression{
-// 		{Id: "1", Status: "done", Result: func() *float64 { f := 6.0; return &f }()},
-// 		{Id: "2", Status: "pending", Result: nil},
-// 	}
-
-// 	req := httptest.NewRequest(http.MethodGet, "/api/v1/expressions", nil)
-// 	rr := httptest.NewRecorder()
-
-// 	orchestrator.GetExpressionsHandler(rr, req)
-
-// 	if rr.Code != http.StatusOK {
-// 		t.Errorf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
-// 	}
-
-// 	expectedBody := `{"expressions":[{"id":"1","status":"done","result":6},{"id":"2","status":"pending","result":null}]}`
-// 	if !JSONBytesEqual(rr.Body.Bytes(), []byte(expectedBody)) {
-// 		t.Errorf("Expected body %s, but got %s", expectedBody, rr.Body.String())
-// 	}
-// }
-
-// func TestExpressionFromID(t *testing.T) {
-// 	orchestrator := application.NewOrchestrator(4)
-// 	orchestrator.Exprs = []application.Expression{
-// 		{Id: "1", Status: "done", Result: func() *float64 { f := 10.0; return &f }()},
-// 		{Id: "2", Status: "pending", Result: nil},
-// 	}
-
-// 	tt := []struct {
-// 		name           string
-// 		id             string
-// 		expectedStatus int
-// 		expectedBody   string
-// 	}{
-// 		{
-// 			name:           "Valid ID",
-// 			id:             "1",
-// 			expectedStatus: http.StatusOK,
-// 			expectedBody:   `{"id":"1","status":"done","result":10}`,
-// 		},
-// 		{
-// 			name:           "Invalid ID",
-// 			id:             "999",
-// 			expectedStatus: http.StatusNotFound,
-// 			expectedBody:   `Expression with ID 999 not found`,
-// 		},
-// 	}
-
-// 	for _, tc := range tt {
-// 		t.Run(tc.name, func(t *testing.T) {
-// 			req := httptest.NewRequest(http.MethodGet, "/api/v1/expressions/"+tc.id, nil)
-// 			req.SetPathValue("id", tc.id)
-
-// 			rr := httptest.NewRecorder()
-
-// 			orchestrator.ExpressionFromID(rr, req)
-
-// 			if rr.Code != tc.expectedStatus {
-// 				t.Errorf("Expected status code %d, but got %d", tc.expectedStatus, rr.Code)
-// 			}
-
-// 			// убираю лишние пробелы и переносы строк
-// 			body := strings.TrimSpace(rr.Body.String())
-// 			expectedBody := strings.TrimSpace(tc.expectedBody)
-
-// 			if body != expectedBody {
-// 				t.Errorf("Expected body `%s`, but got `%s`", expectedBody, body)
-// 			}
-// 		})
-// 	}
-// }
-
-// func TestExpressionFromID_InternalServerError(t *testing.T) {
-// 	orchestrator := application.NewOrchestrator(4)
-
-// 	req := httptest.NewRequest(http.MethodGet, "/api/v1/expressions/1", nil)
-// 	req.SetPathValue("id", "1")
-
-// 	rr := httptest.NewRecorder()
-
-// 	orchestrator.ExpressionFromID(rr, req)
-
-// 	if rr.Code != http.StatusNotFound {
-// 		t.Errorf("Expected status code %d, but got %d", http.StatusNotFound, rr.Code)
-// 	}
-
-// 	body := strings.TrimSpace(rr.Body.String())
-// 	expectedBody := strings.TrimSpace(`Expression with ID 1 not found`)
-
-// 	if body != expectedBody {
-// 		t.Errorf("Expected body `%s`, but got `%s`", expectedBody, body)
-// 	}
-
-// }
-
-// func JSONBytesEqual(a, b []byte) bool {
-// 	var j, j2 interface{}
-// 	if err := json.Unmarshal(a, &j); err != nil {
-// 		return false
-// 	}
-// 	if err := json.Unmarshal(b, &j2); err != nil {
-// 		return false
-// 	}
-// 	return reflect.DeepEqual(j2, j)
-// }
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shzuzu/Go_Calculator/internal/application"
+	"github.com/shzuzu/Go_Calculator/internal/auth"
+	"github.com/shzuzu/Go_Calculator/internal/database/repo"
+	"github.com/shzuzu/Go_Calculator/internal/middleware"
+	"github.com/shzuzu/Go_Calculator/pkg/calc"
+)
+
+// fakeCalculator computes in-process instead of calling a calc server.
+type fakeCalculator struct {
+	evaluator *calc.Evaluator
+}
+
+func (c *fakeCalculator) ValidateExpression(expression string, variables map[string]float64) error {
+	return calc.Validate(expression, variables)
+}
+
+func (c *fakeCalculator) Compute(ctx context.Context, operation string, args []float64) (float64, error) {
+	return c.evaluator.Apply(ctx, operation, args)
+}
+
+func newFakeCalculator() *fakeCalculator {
+	return &fakeCalculator{evaluator: calc.NewEvaluator(calc.Config{})}
+}
+
+func newTestOrchestrator() (*application.Orchestrator, *repo.MemoryRepository) {
+	return newTestOrchestratorWith(newFakeCalculator())
+}
+
+func newTestOrchestratorWith(calculator application.CalculatorClient) (*application.Orchestrator, *repo.MemoryRepository) {
+	expressions := repo.NewMemoryRepository()
+	return application.NewOrchestrator(expressions, auth.NewMemoryUserStore(), calculator), expressions
+}
+
+// startJobs runs job workers and calculator workers until the test ends.
+func startJobs(t *testing.T, orchestrator *application.Orchestrator, workers, capacity int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	orchestrator.StartWorkers(ctx, 2*workers)
+	if err := orchestrator.StartJobs(ctx, workers, capacity); err != nil {
+		t.Fatalf("Failed to start jobs: %v", err)
+	}
+}
+
+// waitExpression returns the expression once it is finished.
+func waitExpression(t *testing.T, orchestrator *application.Orchestrator, userID int64, id string) *repo.Expression {
+	req := newRequest(http.MethodGet, "/api/v1/expressions/"+id+"?wait=5s", "", userID)
+	req.SetPathValue("id", id)
+	rr := httptest.NewRecorder()
+	orchestrator.ExpressionFromID(rr, req)
+
+	var expr repo.Expression
+	if err := json.Unmarshal(rr.Body.Bytes(), &expr); err != nil {
+		t.Fatalf("Failed to decode expression: %v: %s", err, rr.Body)
+	}
+	return &expr
+}
+
+// newRequest makes a request of the user as if it passed the auth
+// middleware; userID 0 means an anonymous request.
+func newRequest(method, target, body string, userID int64) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if userID != 0 {
+		req = req.WithContext(context.WithValue(req.Context(), middleware.UserIDKey, userID))
+	}
+	return req
+}
+
+func TestCreateExpressionHandler(t *testing.T) {
+	tt := []struct {
+		name           string
+		body           string
+		userID         int64
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:           "Valid Expression",
+			body:           `{"expression":"2+2*2"}`,
+			userID:         1,
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "Invalid Expression",
+			body:           `{"expression":"2(+()"}`,
+			userID:         1,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  "Expression is not valid",
+		},
+		{
+			name:           "Division by Zero",
+			body:           `{"expression":"1/0"}`,
+			userID:         1,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  "Division by zero",
+		},
+		{
+			name:           "Assignment",
+			body:           `{"expression":"r = 3","variables":{"r":1}}`,
+			userID:         1,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  "r: assignment requires an environment",
+		},
+		{
+			name:           "Malformed Body",
+			body:           `{"expression":`,
+			userID:         1,
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectedError:  "Unprocessable Entity",
+		},
+		{
+			name:           "Callbacks Disabled",
+			body:           `{"expression":"1+1","callback_url":"http://example.com/hook"}`,
+			userID:         1,
+			expectedStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:           "Unauthorized",
+			body:           `{"expression":"2+2"}`,
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			orchestrator, _ := newTestOrchestrator()
+			rr := httptest.NewRecorder()
+
+			orchestrator.CreateExpressionHandler(rr, newRequest(http.MethodPost, "/api/v1/calculate", tc.body, tc.userID))
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, but got %d: %s", tc.expectedStatus, rr.Code, rr.Body)
+			}
+			switch {
+			case tc.expectedStatus == http.StatusCreated:
+				if !JSONBytesEqual(rr.Body.Bytes(), []byte(`{"id":"1"}`)) {
+					t.Fatalf("Expected id 1, but got %s", rr.Body)
+				}
+			case tc.expectedError != "":
+				var body application.Error
+				if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Error != tc.expectedError {
+					t.Fatalf("Expected error %q, but got %s", tc.expectedError, rr.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestGetExpressionsHandler(t *testing.T) {
+	orchestrator, expressions := newTestOrchestrator()
+	first, _ := expressions.CreateWithJob(1, "2+2", nil, "")
+	expressions.CreateWithJob(1, "3*3", nil, "")
+	expressions.CreateWithJob(2, "4-4", nil, "")
+	result := 4.0
+	expressions.UpdateStatus(first, "done", &result)
+
+	rr := httptest.NewRecorder()
+	orchestrator.GetExpressionsHandler(rr, newRequest(http.MethodGet, "/api/v1/expressions?limit=1", "", 1))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
+	}
+	var page application.ExpressionsPage
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Failed to decode page: %v", err)
+	}
+	if len(page.Expressions) != 1 || page.Expressions[0].Expression != "3*3" || page.NextCursor == "" {
+		t.Fatalf("Unexpected first page: %s", rr.Body)
+	}
+
+	rr = httptest.NewRecorder()
+	orchestrator.GetExpressionsHandler(rr, newRequest(http.MethodGet, "/api/v1/expressions?after="+page.NextCursor, "", 1))
+
+	page = application.ExpressionsPage{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Failed to decode page: %v", err)
+	}
+	if len(page.Expressions) != 1 || page.Expressions[0].Status != "done" || *page.Expressions[0].Result != 4 || page.NextCursor != "" {
+		t.Fatalf("Unexpected second page: %s", rr.Body)
+	}
+}
+
+func TestExpressionFromID(t *testing.T) {
+	orchestrator, expressions := newTestOrchestrator()
+	expressions.CreateWithJob(1, "5+5", nil, "")
+	expressions.CreateWithJob(2, "6+6", nil, "")
+	result := 10.0
+	expressions.UpdateStatus(1, "done", &result)
+
+	tt := []struct {
+		name           string
+		id             string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Valid ID",
+			id:             "1",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Expression of Another User",
+			id:             "2",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `Expression with ID 2 not found`,
+		},
+		{
+			name:           "Unknown ID",
+			id:             "999",
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   `Expression with ID 999 not found`,
+		},
+		{
+			name:           "Invalid ID",
+			id:             "abc",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `Invalid ID`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newRequest(http.MethodGet, "/api/v1/expressions/"+tc.id, "", 1)
+			req.SetPathValue("id", tc.id)
+
+			rr := httptest.NewRecorder()
+
+			orchestrator.ExpressionFromID(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, but got %d", tc.expectedStatus, rr.Code)
+			}
+
+			if tc.expectedStatus == http.StatusOK {
+				var expr repo.Expression
+				if err := json.Unmarshal(rr.Body.Bytes(), &expr); err != nil || expr.ID != "1" || *expr.Result != 10 {
+					t.Fatalf("Unexpected expression: %s", rr.Body)
+				}
+				return
+			}
+
+			// убираю лишние пробелы и переносы строк
+			body := strings.TrimSpace(rr.Body.String())
+			if body != tc.expectedBody {
+				t.Fatalf("Expected body `%s`, but got `%s`", tc.expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestCancelExpressionHandler(t *testing.T) {
+	orchestrator, expressions := newTestOrchestrator()
+	expressions.CreateWithJob(1, "7+7", nil, "")
+
+	for _, expectedStatus := range []int{http.StatusOK, http.StatusConflict} {
+		req := newRequest(http.MethodDelete, "/api/v1/expressions/1", "", 1)
+		req.SetPathValue("id", "1")
+		rr := httptest.NewRecorder()
+
+		orchestrator.CancelExpressionHandler(rr, req)
+
+		if rr.Code != expectedStatus {
+			t.Fatalf("Expected status code %d, but got %d", expectedStatus, rr.Code)
+		}
+	}
+
+	expr, _ := expressions.GetByID(1)
+	if expr.Status != "cancelled" || expr.CompletedAt == nil {
+		t.Fatalf("Expected a cancelled expression, got %+v", expr)
+	}
+}
+
+func TestExpressionIsEvaluated(t *testing.T) {
+	orchestrator, _ := newTestOrchestrator()
+	startJobs(t, orchestrator, 1, 10)
+
+	rr := httptest.NewRecorder()
+	orchestrator.CreateExpressionHandler(rr, newRequest(http.MethodPost, "/api/v1/calculate", `{"expression":"x*(2+3)","variables":{"x":4}}`, 1))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, but got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+
+	expr := waitExpression(t, orchestrator, 1, "1")
+	if expr.Status != "done" || expr.Result == nil || *expr.Result != 20 {
+		t.Fatalf("Expected result 20, got %+v", expr)
+	}
+}
+
+func TestCreateExpressionHandlerQueueFull(t *testing.T) {
+	orchestrator, _ := newTestOrchestrator()
+	// без воркеров задания остаются в очереди
+	startJobs(t, orchestrator, 0, 2)
+
+	for i, expectedStatus := range []int{http.StatusCreated, http.StatusCreated, http.StatusServiceUnavailable} {
+		rr := httptest.NewRecorder()
+		orchestrator.CreateExpressionHandler(rr, newRequest(http.MethodPost, "/api/v1/calculate", `{"expression":"1+1"}`, 1))
+		if rr.Code != expectedStatus {
+			t.Fatalf("Submission %d: expected status code %d, but got %d: %s", i+1, expectedStatus, rr.Code, rr.Body)
+		}
+		if expectedStatus == http.StatusServiceUnavailable && rr.Header().Get("Retry-After") != "5" {
+			t.Fatalf("Expected Retry-After: 5, got %q", rr.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestCreateExpressionHandlerIdempotency(t *testing.T) {
+	orchestrator, expressions := newTestOrchestrator()
+	// без воркеров: после двух выражений очередь заполнена
+	startJobs(t, orchestrator, 0, 2)
+
+	steps := []struct {
+		name           string
+		userID         int64
+		key            string
+		body           string
+		expectedStatus int
+		expectedID     string
+	}{
+		{"First Request", 1, "k", `{"expression":"x+y","variables":{"x":1,"y":2}}`, http.StatusCreated, "1"},
+		{"Replay", 1, "k", `{"variables":{"y":2,"x":1},"expression":"x+y"}`, http.StatusCreated, "1"},
+		{"Different Body", 1, "k", `{"expression":"x+y","variables":{"x":1,"y":3}}`, http.StatusUnprocessableEntity, ""},
+		{"Other User", 2, "k", `{"expression":"x+y","variables":{"x":1,"y":2}}`, http.StatusCreated, "2"},
+		{"Replay With Full Queue", 1, "k", `{"expression":"x+y","variables":{"x":1,"y":2}}`, http.StatusCreated, "1"},
+		{"New Key With Full Queue", 1, "other", `{"expression":"x+y","variables":{"x":1,"y":2}}`, http.StatusServiceUnavailable, ""},
+	}
+
+	for _, step := range steps {
+		rr := httptest.NewRecorder()
+		req := newRequest(http.MethodPost, "/api/v1/calculate", step.body, step.userID)
+		req.Header.Set("Idempotency-Key", step.key)
+		orchestrator.CreateExpressionHandler(rr, req)
+
+		if rr.Code != step.expectedStatus {
+			t.Fatalf("%s: expected status code %d, but got %d: %s", step.name, step.expectedStatus, rr.Code, rr.Body)
+		}
+		if step.expectedID != "" {
+			var id application.Id
+			if err := json.Unmarshal(rr.Body.Bytes(), &id); err != nil || id.Id != step.expectedID {
+				t.Fatalf("%s: expected id %s, got %s", step.name, step.expectedID, rr.Body)
+			}
+		}
+	}
+
+	for userID, expected := range map[int64]int{1: 1, 2: 1} {
+		if list, _ := expressions.ListExpressions(userID, repo.ExpressionQuery{}); len(list) != expected {
+			t.Fatalf("Expected %d expressions of user %d, got %d", expected, userID, len(list))
+		}
+	}
+}
+
+func TestRegisterAndLoginHandlers(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test")
+	orchestrator, _ := newTestOrchestrator()
+	credentials := `{"login":"user","password":"secret"}`
+
+	tt := []struct {
+		name           string
+		handler        http.HandlerFunc
+		body           string
+		expectedStatus int
+	}{
+		{"Register", orchestrator.RegisterHandler, credentials, http.StatusOK},
+		{"Register Again", orchestrator.RegisterHandler, credentials, http.StatusConflict},
+		{"Login", orchestrator.LoginHandler, credentials, http.StatusOK},
+		{"Wrong Password", orchestrator.LoginHandler, `{"login":"user","password":"wrong"}`, http.StatusUnauthorized},
+		{"Empty Login", orchestrator.LoginHandler, `{"password":"secret"}`, http.StatusBadRequest},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tc.handler(rr, newRequest(http.MethodPost, "/api/v1/login", tc.body, 0))
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status code %d, but got %d: %s", tc.expectedStatus, rr.Code, rr.Body)
+			}
+		})
+	}
+}
+
+func TestInternalTaskHandlerRequiresAgentToken(t *testing.T) {
+	orchestrator, _ := newTestOrchestrator()
+
+	tt := []struct {
+		name           string
+		acceptToken    string
+		header         string
+		expectedStatus int
+	}{
+		{"Agents Disabled", "", "Bearer ", http.StatusUnauthorized},
+		{"No Token", "secret", "", http.StatusUnauthorized},
+		{"Wrong Token", "secret", "Bearer wrong", http.StatusUnauthorized},
+		{"Malformed Header", "secret", "secret", http.StatusUnauthorized},
+		{"Valid Token", "secret", "Bearer secret", http.StatusNotFound},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			orchestrator.AcceptAgents(tc.acceptToken)
+			for _, method := range []string{http.MethodGet, http.MethodPost} {
+				req := newRequest(method, "/internal/task", `{"id":1,"result":42}`, 0)
+				if tc.header != "" {
+					req.Header.Set("Authorization", tc.header)
+				}
+				rr := httptest.NewRecorder()
+
+				orchestrator.InternalTaskHandler(rr, req)
+
+				// 404 с верным токеном: задач нет, и задачи 1 оркестратор не ждет
+				if rr.Code != tc.expectedStatus {
+					t.Fatalf("%s: expected status code %d, but got %d", method, tc.expectedStatus, rr.Code)
+				}
+			}
+		})
+	}
+}
+
+func JSONBytesEqual(a, b []byte) bool {
+	var j, j2 interface{}
+	if err := json.Unmarshal(a, &j); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(b, &j2); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(j2, j)
+}
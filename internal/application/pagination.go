@@ -0,0 +1,85 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/database/repo"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// ExpressionsPage is one page of GET /api/v1/expressions. NextCursor is
+// passed as ?after= to get the next page and is empty on the last one.
+type ExpressionsPage struct {
+	Expressions []*repo.Expression `json:"expressions"`
+	NextCursor  string             `json:"next_cursor,omitempty"`
+}
+
+var expressionStatuses = map[string]bool{
+	"pending":   true,
+	"computing": true,
+	"done":      true,
+	"error":     true,
+	"cancelled": true,
+}
+
+// parseExpressionQuery reads limit, after, status, created_after,
+// created_before and order from the query string.
+func parseExpressionQuery(values url.Values) (repo.ExpressionQuery, error) {
+	query := repo.ExpressionQuery{Limit: defaultPageSize}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return query, fmt.Errorf("limit must be from 1 to %d", maxPageSize)
+		}
+		query.Limit = limit
+	}
+
+	if v := values.Get("after"); v != "" {
+		after, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || after < 1 {
+			return query, errors.New("Invalid cursor")
+		}
+		query.After = after
+	}
+
+	if v := values.Get("status"); v != "" {
+		if !expressionStatuses[v] {
+			return query, errors.New("Unknown status")
+		}
+		query.Status = v
+	}
+
+	var err error
+	if query.CreatedAfter, err = parseTime(values.Get("created_after")); err != nil {
+		return query, errors.New("created_after must be an RFC 3339 time")
+	}
+	if query.CreatedBefore, err = parseTime(values.Get("created_before")); err != nil {
+		return query, errors.New("created_before must be an RFC 3339 time")
+	}
+
+	switch values.Get("order") {
+	case "", "desc":
+	case "asc":
+		query.Ascending = true
+	default:
+		return query, errors.New("order must be asc or desc")
+	}
+
+	return query, nil
+}
+
+func parseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
@@ -0,0 +1,210 @@
+package application
+
+import (
+	"context"
+	"log"
+
+	"github.com/shzuzu/Go_Calculator/internal/agent"
+	"github.com/shzuzu/Go_Calculator/pkg/calc"
+)
+
+type stepResult struct {
+	step  int
+	value float64
+	err   error
+}
+
+// runExpression decomposes an expression into operation tasks, runs them
+// and returns the result. Tasks left by an earlier attempt are reused, so
+// operations that are already done are not computed again.
+func (o *Orchestrator) runExpression(ctx context.Context, id int64, request *Request) (float64, error) {
+	plan, err := calc.NewPlan(request.Expression, request.Variables)
+	if err != nil {
+		return 0, err
+	}
+	if len(plan.Steps) == 0 {
+		return plan.Value, nil
+	}
+
+	operations := make([]string, len(plan.Steps))
+	for i, step := range plan.Steps {
+		operations[i] = step.Op
+	}
+	taskIDs, done, err := o.prepareTasks(id, operations)
+	if err != nil {
+		return 0, err
+	}
+
+	return o.runPlan(ctx, plan, taskIDs, done)
+}
+
+// prepareTasks returns the task IDs of the expression and the results of
+// the steps that are already done.
+func (o *Orchestrator) prepareTasks(id int64, operations []string) ([]int64, map[int]float64, error) {
+	existing, err := o.expressionRepo.GetTasksByExpressionID(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reuse := len(existing) == len(operations)
+	for i := 0; reuse && i < len(existing); i++ {
+		reuse = existing[i].Step == i && existing[i].Operation == operations[i]
+	}
+	if !reuse {
+		taskIDs, err := o.expressionRepo.CreateTasks(id, operations)
+		return taskIDs, nil, err
+	}
+
+	taskIDs := make([]int64, len(existing))
+	done := make(map[int]float64)
+	for i, task := range existing {
+		taskIDs[i] = task.ID
+		if task.Status == "done" && task.Result != nil {
+			done[i] = *task.Result
+		}
+	}
+	log.Printf("prepareTasks: expression %d resumes with %d of %d tasks done", id, len(done), len(taskIDs))
+	return taskIDs, done, nil
+}
+
+// runPlan submits every task whose dependencies are known to the dispatcher,
+// feeds each result into its parents and returns the result of the root
+// task. Steps in done are not submitted again. After the first failure the
+// remaining tasks are withdrawn and nothing new starts.
+func (o *Orchestrator) runPlan(ctx context.Context, plan *calc.Plan, taskIDs []int64, done map[int]float64) (float64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	values := make([]float64, len(plan.Steps))
+	waiting := make([]int, len(plan.Steps))
+	dependents := make([][]int, len(plan.Steps))
+	for i, step := range plan.Steps {
+		deps := step.Deps()
+		waiting[i] = len(deps)
+		for _, dep := range deps {
+			dependents[dep] = append(dependents[dep], i)
+		}
+	}
+
+	results := make(chan stepResult, len(plan.Steps))
+	started := make([]bool, len(plan.Steps))
+	running := 0
+	start := func(i int) {
+		step := plan.Steps[i]
+		args := make([]float64, len(step.Args))
+		for j, arg := range step.Args {
+			if arg.Step >= 0 {
+				args[j] = values[arg.Step]
+			} else {
+				args[j] = arg.Value
+			}
+		}
+
+		started[i] = true
+		running++
+		o.expressionRepo.UpdateTaskStatus(taskIDs[i], "computing", nil)
+		o.dispatcher.Submit(&dispatchedTask{
+			Task:    agent.Task{ID: taskIDs[i], Operation: step.Op, Args: args},
+			step:    i,
+			ctx:     ctx,
+			results: results,
+		})
+	}
+
+	for i, value := range done {
+		values[i] = value
+		started[i] = true
+		for _, parent := range dependents[i] {
+			waiting[parent]--
+		}
+	}
+	for i := range plan.Steps {
+		if waiting[i] == 0 && !started[i] {
+			start(i)
+		}
+	}
+
+	var firstErr error
+	stop := func(err error) {
+		firstErr = err
+		cancel()
+		for _, id := range o.dispatcher.Cancel(taskIDs) {
+			running--
+			o.expressionRepo.UpdateTaskStatus(id, "cancelled", nil)
+		}
+	}
+
+	cancelled := ctx.Done()
+	for running > 0 {
+		var res stepResult
+		select {
+		case res = <-results:
+		case <-cancelled:
+			// ждем только результаты, которые уже доставлены
+			cancelled = nil
+			if firstErr == nil {
+				log.Printf("runPlan: cancelled: %v", ctx.Err())
+				stop(ctx.Err())
+			}
+			continue
+		}
+		running--
+
+		if res.err != nil {
+			status := "error"
+			if ctx.Err() != nil {
+				// задачу прервала отмена, а не ошибка вычисления
+				status, res.err = "cancelled", ctx.Err()
+			} else {
+				log.Printf("runPlan: task %d failed: %v", taskIDs[res.step], res.err)
+			}
+			o.expressionRepo.UpdateTaskStatus(taskIDs[res.step], status, nil)
+			if firstErr == nil {
+				stop(res.err)
+			}
+			continue
+		}
+
+		values[res.step] = res.value
+		o.expressionRepo.UpdateTaskStatus(taskIDs[res.step], "done", &res.value)
+		if firstErr != nil {
+			continue
+		}
+		for _, parent := range dependents[res.step] {
+			waiting[parent]--
+			if waiting[parent] == 0 {
+				start(parent)
+			}
+		}
+	}
+
+	if firstErr != nil {
+		for i, ok := range started {
+			if !ok {
+				o.expressionRepo.UpdateTaskStatus(taskIDs[i], "cancelled", nil)
+			}
+		}
+		return 0, firstErr
+	}
+	return values[len(values)-1], nil
+}
+
+// StartWorkers runs n in-process executors that take tasks from the
+// dispatcher and compute them with the gRPC calculator until ctx is done.
+func (o *Orchestrator) StartWorkers(ctx context.Context, n int) {
+	log.Printf("Orchestrator: starting %d gRPC workers", n)
+	for i := 0; i < n; i++ {
+		go func() {
+			for {
+				task, err := o.dispatcher.Next(ctx)
+				if err != nil {
+					return
+				}
+				callCtx, cancel := context.WithTimeout(task.ctx, taskLease)
+				value, err := o.calculatorClient.Compute(callCtx, task.Operation, task.Args)
+				cancel()
+				o.dispatcher.Complete(task.ID, value, err)
+			}
+		}()
+	}
+}
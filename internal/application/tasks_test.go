@@ -0,0 +1,173 @@
+package application_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// barrierCalculator holds every addition until two of them run at once, so
+// a plan that starts independent tasks one by one never finishes.
+type barrierCalculator struct {
+	*fakeCalculator
+	mu        sync.Mutex
+	calls     []string
+	additions int
+	both      chan struct{}
+}
+
+func (c *barrierCalculator) Compute(ctx context.Context, operation string, args []float64) (float64, error) {
+	c.mu.Lock()
+	c.calls = append(c.calls, fmt.Sprint(operation, args))
+	if operation == "+" {
+		c.additions++
+		if c.additions == 2 {
+			close(c.both)
+		}
+	}
+	c.mu.Unlock()
+
+	if operation == "+" {
+		select {
+		case <-c.both:
+		case <-time.After(2 * time.Second):
+			return 0, errors.New("additions did not run in parallel")
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	return c.fakeCalculator.Compute(ctx, operation, args)
+}
+
+func TestIndependentTasksRunInParallel(t *testing.T) {
+	calculator := &barrierCalculator{fakeCalculator: newFakeCalculator(), both: make(chan struct{})}
+	orchestrator, _ := newTestOrchestratorWith(calculator)
+	startJobs(t, orchestrator, 1, 10)
+
+	rr := httptest.NewRecorder()
+	orchestrator.CreateExpressionHandler(rr, newRequest(http.MethodPost, "/api/v1/calculate", `{"expression":"(1+2)*(3+4)"}`, 1))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, but got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+
+	expr := waitExpression(t, orchestrator, 1, "1")
+	if expr.Status != "done" || expr.Result == nil || *expr.Result != 21 {
+		t.Fatalf("Expected result 21, got %+v", expr)
+	}
+
+	calculator.mu.Lock()
+	defer calculator.mu.Unlock()
+	// умножение начинается только после обоих сложений и получает их результаты
+	if len(calculator.calls) != 3 || calculator.calls[2] != "*[3 7]" {
+		t.Fatalf("Expected two additions and then *[3 7], got %v", calculator.calls)
+	}
+}
+
+// blockingCalculator holds every computation until its context is done.
+type blockingCalculator struct {
+	*fakeCalculator
+	started chan struct{}
+	stopped chan error
+}
+
+func (c *blockingCalculator) Compute(ctx context.Context, operation string, args []float64) (float64, error) {
+	c.started <- struct{}{}
+	<-ctx.Done()
+	c.stopped <- ctx.Err()
+	return 0, ctx.Err()
+}
+
+func TestCancelStopsComputation(t *testing.T) {
+	calculator := &blockingCalculator{fakeCalculator: newFakeCalculator(), started: make(chan struct{}, 1), stopped: make(chan error, 1)}
+	orchestrator, expressions := newTestOrchestratorWith(calculator)
+	startJobs(t, orchestrator, 1, 10)
+
+	rr := httptest.NewRecorder()
+	orchestrator.CreateExpressionHandler(rr, newRequest(http.MethodPost, "/api/v1/calculate", `{"expression":"(1+2)*3"}`, 1))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, but got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+	select {
+	case <-calculator.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Computation did not start")
+	}
+
+	req := newRequest(http.MethodDelete, "/api/v1/expressions/1", "", 1)
+	req.SetPathValue("id", "1")
+	rr = httptest.NewRecorder()
+	orchestrator.CancelExpressionHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	select {
+	case err := <-calculator.stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected computation to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Computation was not cancelled")
+	}
+
+	// и начатая, и не начатая задачи отменены, а не завершены с ошибкой
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tasks, err := expressions.GetTasksByExpressionID(1)
+		if err != nil {
+			t.Fatalf("Failed to get tasks: %v", err)
+		}
+		statuses := make([]string, len(tasks))
+		settled := true
+		for i, task := range tasks {
+			statuses[i] = task.Status
+			settled = settled && task.Status == "cancelled"
+		}
+		if settled && len(tasks) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected two cancelled tasks, got %v", statuses)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if expr := waitExpression(t, orchestrator, 1, "1"); expr.Status != "cancelled" {
+		t.Fatalf("Expected status 'cancelled', got %+v", expr)
+	}
+}
+
+func TestCancelOnAnotherReplica(t *testing.T) {
+	calculator := &blockingCalculator{fakeCalculator: newFakeCalculator(), started: make(chan struct{}, 1), stopped: make(chan error, 1)}
+	orchestrator, expressions := newTestOrchestratorWith(calculator)
+	startJobs(t, orchestrator, 1, 10)
+
+	rr := httptest.NewRecorder()
+	orchestrator.CreateExpressionHandler(rr, newRequest(http.MethodPost, "/api/v1/calculate", `{"expression":"1+2"}`, 1))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, but got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+	select {
+	case <-calculator.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Computation did not start")
+	}
+
+	// другая реплика отменяет выражение в базе, минуя этот оркестратор
+	if ok, err := expressions.CancelExpression(1); err != nil || !ok {
+		t.Fatalf("Failed to cancel expression: %v, %v", ok, err)
+	}
+	select {
+	case err := <-calculator.stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected computation to be cancelled, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Computation was not cancelled")
+	}
+}
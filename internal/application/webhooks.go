@@ -0,0 +1,122 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/database/repo"
+	"github.com/shzuzu/Go_Calculator/internal/webhook"
+)
+
+const (
+	// callbackLease covers all attempts of one delivery; a delivery that
+	// is not finished in time is started again
+	callbackLease   = 5 * time.Minute
+	callbackWorkers = 4
+	// callbackLookupTimeout limits the resolution of a callback host
+	callbackLookupTimeout = 5 * time.Second
+)
+
+// EnableWebhooks makes the orchestrator accept callback_url and deliver
+// callbacks with sender.
+func (o *Orchestrator) EnableWebhooks(sender *webhook.Sender) {
+	o.webhooks = sender
+}
+
+// checkCallback validates the callback_url of a request. An empty URL is
+// fine: the expression just has no callback.
+func (o *Orchestrator) checkCallback(callbackURL string) *Error {
+	if callbackURL == "" {
+		return nil
+	}
+	if o.webhooks == nil {
+		return &Error{Error: "Callbacks are not enabled on this server"}
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &Error{Error: "callback_url must be an absolute http or https URL"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), callbackLookupTimeout)
+	defer cancel()
+	if err := o.webhooks.CheckHost(ctx, u.Hostname()); err != nil {
+		if errors.Is(err, webhook.ErrForbiddenAddress) {
+			return &Error{Error: "callback_url must point to a public address"}
+		}
+		return &Error{Error: "callback_url host cannot be resolved"}
+	}
+	return nil
+}
+
+// notifyCallbacks wakes up a callback worker after a job with a callback
+// was finished.
+func (o *Orchestrator) notifyCallbacks() {
+	select {
+	case o.callbacksReady <- struct{}{}:
+	default:
+	}
+}
+
+// callbackWorker delivers the callbacks of finished jobs until ctx is done.
+// Deliveries are stored with the jobs, so the ones interrupted by a restart
+// are picked up again.
+func (o *Orchestrator) callbackWorker(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, err := o.expressionRepo.ClaimCallback(callbackLease)
+		if err != nil {
+			log.Printf("callbackWorker: failed to claim callback: %v", err)
+		}
+		if job != nil {
+			o.deliverCallback(ctx, job)
+			continue
+		}
+
+		select {
+		case <-o.callbacksReady:
+		case <-time.After(jobPollInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// deliverCallback posts the finished expression to the callback URL of its
+// job, logs every attempt and records the outcome.
+func (o *Orchestrator) deliverCallback(ctx context.Context, job *repo.Job) {
+	expr, err := o.expressionRepo.GetByID(job.ExpressionID)
+	if err != nil || expr == nil {
+		log.Printf("deliverCallback: failed to load expression %d: %v", job.ExpressionID, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, callbackLease/2)
+	defer cancel()
+	err = o.webhooks.Send(ctx, job.CallbackURL, expr, func(d webhook.Delivery) {
+		delivery := &repo.WebhookDelivery{
+			ExpressionID: job.ExpressionID,
+			URL:          d.URL,
+			Attempt:      d.Attempt,
+			StatusCode:   d.StatusCode,
+		}
+		if d.Err != nil {
+			delivery.Error = d.Err.Error()
+		}
+		o.expressionRepo.RecordDelivery(delivery)
+	})
+
+	status := "delivered"
+	switch {
+	case ctx.Err() != nil && errors.Is(err, context.Canceled):
+		// сервер останавливается: доставку продолжит следующий запуск
+		log.Printf("deliverCallback: delivery of expression %d interrupted", job.ExpressionID)
+		return
+	case err != nil:
+		log.Printf("deliverCallback: giving up on expression %d: %v", job.ExpressionID, err)
+		status = "failed"
+	default:
+		log.Printf("deliverCallback: expression %d delivered to %s", job.ExpressionID, job.CallbackURL)
+	}
+	o.expressionRepo.FinishCallback(job.ID, status)
+}
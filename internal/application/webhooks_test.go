@@ -0,0 +1,151 @@
+package application_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/database/repo"
+	"github.com/shzuzu/Go_Calculator/internal/webhook"
+)
+
+// newCallbackServer returns a receiver that passes on the expressions it
+// gets, and a sender allowed to reach it on loopback.
+func newCallbackServer(t *testing.T) (*httptest.Server, <-chan repo.Expression, *webhook.Sender) {
+	received := make(chan repo.Expression, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !webhook.Verify([]byte("secret"), body, r.Header.Get(webhook.SignatureHeader)) {
+			t.Errorf("Invalid signature %q", r.Header.Get(webhook.SignatureHeader))
+		}
+		var expr repo.Expression
+		json.Unmarshal(body, &expr)
+		received <- expr
+	}))
+	t.Cleanup(server.Close)
+
+	sender := webhook.NewSender("secret")
+	sender.BaseDelay = time.Millisecond
+	sender.AllowPrivate = true
+	return server, received, sender
+}
+
+func nextCallback(t *testing.T, received <-chan repo.Expression) repo.Expression {
+	t.Helper()
+	select {
+	case expr := <-received:
+		return expr
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a callback")
+	}
+	return repo.Expression{}
+}
+
+// waitDeliveries waits until the delivery log of an expression has n
+// attempts; it is written right after the receiver answers.
+func waitDeliveries(t *testing.T, expressions *repo.MemoryRepository, id int64, n int) []*repo.WebhookDelivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries, _ := expressions.GetDeliveries(id)
+		if len(deliveries) >= n {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d deliveries of expression %d, got %d", n, id, len(deliveries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCreateExpressionHandlerRejectsPrivateCallbacks(t *testing.T) {
+	orchestrator, _ := newTestOrchestrator()
+	orchestrator.EnableWebhooks(webhook.NewSender("secret"))
+
+	for _, callbackURL := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://10.0.0.5/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+	} {
+		rr := httptest.NewRecorder()
+		body := `{"expression":"1+1","callback_url":"` + callbackURL + `"}`
+		orchestrator.CreateExpressionHandler(rr, newRequest(http.MethodPost, "/api/v1/calculate", body, 1))
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("%s: expected status code %d, but got %d: %s", callbackURL, http.StatusUnprocessableEntity, rr.Code, rr.Body)
+		}
+	}
+}
+
+func TestCallbackIsDelivered(t *testing.T) {
+	server, received, sender := newCallbackServer(t)
+	orchestrator, expressions := newTestOrchestrator()
+	orchestrator.EnableWebhooks(sender)
+	startJobs(t, orchestrator, 1, 10)
+
+	rr := httptest.NewRecorder()
+	body := `{"expression":"2*3","callback_url":"` + server.URL + `"}`
+	orchestrator.CreateExpressionHandler(rr, newRequest(http.MethodPost, "/api/v1/calculate", body, 1))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, but got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+
+	expr := nextCallback(t, received)
+	if expr.ID != "1" || expr.Status != "done" || expr.Result == nil || *expr.Result != 6 {
+		t.Fatalf("Unexpected callback: %+v", expr)
+	}
+	deliveries := waitDeliveries(t, expressions, 1, 1)
+	if len(deliveries) != 1 || deliveries[0].StatusCode != http.StatusOK {
+		t.Fatalf("Expected one successful delivery, got %+v", deliveries)
+	}
+}
+
+func TestCallbackIsResumedAfterRestart(t *testing.T) {
+	server, received, sender := newCallbackServer(t)
+	orchestrator, expressions := newTestOrchestrator()
+	orchestrator.EnableWebhooks(sender)
+
+	// прошлый запуск посчитал выражение и упал посреди доставки
+	id, _ := expressions.CreateWithJob(1, "1+1", nil, server.URL)
+	job, _ := expressions.ClaimJob(time.Minute)
+	result := 2.0
+	if ok, err := expressions.CompleteJob(job.ID, job.LeaseToken, &result, ""); err != nil || !ok {
+		t.Fatalf("Failed to complete job: %v", err)
+	}
+	if claimed, err := expressions.ClaimCallback(time.Hour); err != nil || claimed == nil {
+		t.Fatalf("Failed to claim callback: %+v, %v", claimed, err)
+	}
+
+	startJobs(t, orchestrator, 1, 10)
+
+	if expr := nextCallback(t, received); expr.ID != "1" || expr.Status != "done" {
+		t.Fatalf("Unexpected callback: %+v", expr)
+	}
+	waitDeliveries(t, expressions, id, 1)
+}
+
+func TestCallbackIsDeliveredOnCancel(t *testing.T) {
+	server, received, sender := newCallbackServer(t)
+	orchestrator, expressions := newTestOrchestrator()
+	orchestrator.EnableWebhooks(sender)
+	// без воркеров выражение остается в очереди до отмены
+	startJobs(t, orchestrator, 0, 10)
+
+	id, _ := expressions.CreateWithJob(1, "1+1", nil, server.URL)
+	req := newRequest(http.MethodDelete, "/api/v1/expressions/1", "", 1)
+	req.SetPathValue("id", "1")
+	rr := httptest.NewRecorder()
+	orchestrator.CancelExpressionHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	if expr := nextCallback(t, received); expr.ID != "1" || expr.Status != "cancelled" || expr.Result != nil {
+		t.Fatalf("Unexpected callback: %+v", expr)
+	}
+	waitDeliveries(t, expressions, id, 1)
+}
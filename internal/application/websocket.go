@@ -0,0 +1,235 @@
+package application
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/shzuzu/Go_Calculator/internal/middleware"
+	"golang.org/x/net/websocket"
+)
+
+// wsMessage is sent by the client. ID is chosen by the client and is
+// echoed in every reply about the request, so many expressions can be in
+// flight on one connection.
+type wsMessage struct {
+	ID   string `json:"id"`
+	Type string `json:"type"` // "calculate" or "cancel"
+	Request
+	ExpressionID string `json:"expression_id,omitempty"`
+}
+
+// wsReply is sent by the server: "accepted" once the expression is stored,
+// "status" on every change, "result" when it is finished, "cancelled" in
+// reply to a cancel and "error" when a request was rejected.
+type wsReply struct {
+	ID           string   `json:"id"`
+	Type         string   `json:"type"`
+	ExpressionID string   `json:"expression_id,omitempty"`
+	Status       string   `json:"status,omitempty"`
+	Result       *float64 `json:"result,omitempty"`
+	Code         int      `json:"code,omitempty"`
+	*Error
+}
+
+// wsProtocol is the subprotocol that carries the JWT for browsers, which
+// cannot set headers on a WebSocket: new WebSocket(url, ["bearer", token]).
+const wsProtocol = "bearer"
+
+// WebSocketHandler serves calculation sessions on /api/v1/ws. The JWT is
+// passed in the Authorization header, the same way as for the REST API, or
+// as the second subprotocol after "bearer".
+func (o *Orchestrator) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	token, ok := middleware.BearerToken(r.Header.Get("Authorization"))
+	viaProtocol := false
+	if !ok {
+		token, ok = protocolToken(r.Header.Get("Sec-WebSocket-Protocol"))
+		viaProtocol = ok
+	}
+	if !ok {
+		http.Error(w, "Authorization header required", http.StatusUnauthorized)
+		return
+	}
+	userID, err := o.authService.ValidateToken(token)
+	if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	server := websocket.Server{
+		// браузер ждет в ответе один из предложенных протоколов; токен не возвращаем
+		Handshake: func(config *websocket.Config, _ *http.Request) error {
+			config.Protocol = nil
+			if viaProtocol {
+				config.Protocol = []string{wsProtocol}
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			newWSSession(o, ws, userID).run()
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// protocolToken extracts the JWT from a Sec-WebSocket-Protocol header of
+// the form "bearer, <token>".
+func protocolToken(header string) (string, bool) {
+	protocols := strings.Split(header, ",")
+	if len(protocols) != 2 || strings.TrimSpace(protocols[0]) != wsProtocol {
+		return "", false
+	}
+	token := strings.TrimSpace(protocols[1])
+	return token, token != ""
+}
+
+type wsSession struct {
+	o      *Orchestrator
+	ws     *websocket.Conn
+	userID int64
+
+	sendMu sync.Mutex
+
+	mu sync.Mutex
+	// tracked maps expression IDs to the request IDs that submitted them
+	tracked map[int64]string
+	// cursor is the last event the session has looked at; rewinds counts
+	// how often a new submission moved it back
+	cursor  int64
+	rewinds int
+}
+
+func newWSSession(o *Orchestrator, ws *websocket.Conn, userID int64) *wsSession {
+	return &wsSession{
+		o:       o,
+		ws:      ws,
+		userID:  userID,
+		tracked: make(map[int64]string),
+	}
+}
+
+func (s *wsSession) run() {
+	log.Printf("wsSession: user %d connected", s.userID)
+	wakeup, unsubscribe := s.o.events.Subscribe(s.userID)
+	defer unsubscribe()
+
+	cursor, err := s.o.expressionRepo.LastEventID(s.userID)
+	if err != nil {
+		return
+	}
+	s.cursor = cursor
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.forwardEvents(wakeup, done)
+
+	for {
+		var msg wsMessage
+		if err := websocket.JSON.Receive(s.ws, &msg); err != nil {
+			log.Printf("wsSession: user %d disconnected: %v", s.userID, err)
+			return
+		}
+		go s.handle(msg)
+	}
+}
+
+func (s *wsSession) handle(msg wsMessage) {
+	switch msg.Type {
+	case "calculate":
+		// события, записанные во время создания, будут перечитаны с этого места
+		since, err := s.o.expressionRepo.LastEventID(s.userID)
+		if err != nil {
+			s.send(wsReply{ID: msg.ID, Type: "error", Code: http.StatusInternalServerError, Error: &Error{Error: "Internal server error"}})
+			return
+		}
+		id, code, apiErr := s.o.submitExpression(s.userID, &msg.Request, "")
+		if apiErr != nil {
+			s.send(wsReply{ID: msg.ID, Type: "error", Code: code, Error: apiErr})
+			return
+		}
+		s.send(wsReply{ID: msg.ID, Type: "accepted", ExpressionID: strconv.FormatInt(id, 10)})
+		s.mu.Lock()
+		s.tracked[id] = msg.ID
+		s.cursor = min(s.cursor, since)
+		s.rewinds++
+		s.mu.Unlock()
+		s.o.events.Notify(s.userID)
+
+	case "cancel":
+		id, err := strconv.ParseInt(msg.ExpressionID, 10, 64)
+		if err != nil {
+			s.send(wsReply{ID: msg.ID, Type: "error", Code: http.StatusBadRequest, Error: &Error{Error: "Invalid ID"}})
+			return
+		}
+		if _, code, apiErr := s.o.cancelExpression(s.userID, id); apiErr != nil {
+			s.send(wsReply{ID: msg.ID, Type: "error", Code: code, Error: apiErr})
+			return
+		}
+		s.send(wsReply{ID: msg.ID, Type: "cancelled", ExpressionID: msg.ExpressionID})
+
+	default:
+		s.send(wsReply{ID: msg.ID, Type: "error", Code: http.StatusBadRequest, Error: &Error{Error: "Unknown message type"}})
+	}
+}
+
+// forwardEvents sends the status changes of the expressions submitted on
+// this connection until done is closed.
+func (s *wsSession) forwardEvents(wakeup <-chan struct{}, done <-chan struct{}) {
+	// lastSent не дает повторить событие после перемотки курсора назад
+	lastSent := make(map[int64]int64)
+	for {
+		select {
+		case <-wakeup:
+		case <-done:
+			return
+		}
+
+		s.mu.Lock()
+		cursor, rewinds := s.cursor, s.rewinds
+		s.mu.Unlock()
+		events, err := s.o.expressionRepo.GetEventsAfter(s.userID, cursor)
+		if err != nil {
+			continue
+		}
+
+		for _, event := range events {
+			cursor = max(cursor, event.ID)
+			exprID, _ := strconv.ParseInt(event.Expression.ID, 10, 64)
+			s.mu.Lock()
+			requestID, ok := s.tracked[exprID]
+			s.mu.Unlock()
+			if !ok || event.ID <= lastSent[exprID] {
+				continue
+			}
+			lastSent[exprID] = event.ID
+
+			reply := wsReply{ID: requestID, Type: "status", ExpressionID: event.Expression.ID, Status: event.Status, Result: event.Result}
+			if finished(event.Status) {
+				reply.Type = "result"
+				s.mu.Lock()
+				delete(s.tracked, exprID)
+				s.mu.Unlock()
+				delete(lastSent, exprID)
+			}
+			s.send(reply)
+		}
+
+		// если курсор перемотали во время прохода, следующий проход
+		// перечитает события с него
+		s.mu.Lock()
+		if s.rewinds == rewinds {
+			s.cursor = cursor
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *wsSession) send(reply wsReply) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	if err := websocket.JSON.Send(s.ws, reply); err != nil {
+		log.Printf("wsSession: failed to send reply to user %d: %v", s.userID, err)
+	}
+}
@@ -0,0 +1,187 @@
+package application_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/application"
+	"golang.org/x/net/websocket"
+)
+
+type wsReply struct {
+	ID           string   `json:"id"`
+	Type         string   `json:"type"`
+	ExpressionID string   `json:"expression_id"`
+	Status       string   `json:"status"`
+	Result       *float64 `json:"result"`
+	Code         int      `json:"code"`
+	Error        string   `json:"error"`
+}
+
+// loginToken registers a user and returns its JWT.
+func loginToken(t *testing.T, orchestrator *application.Orchestrator) string {
+	credentials := `{"login":"ws","password":"secret"}`
+	orchestrator.RegisterHandler(httptest.NewRecorder(), newRequest(http.MethodPost, "/api/v1/register", credentials, 0))
+	rr := httptest.NewRecorder()
+	orchestrator.LoginHandler(rr, newRequest(http.MethodPost, "/api/v1/login", credentials, 0))
+	var token application.Token
+	if err := json.Unmarshal(rr.Body.Bytes(), &token); err != nil || token.Token == "" {
+		t.Fatalf("Failed to log in: %s", rr.Body)
+	}
+	return token.Token
+}
+
+func dialWebSocket(t *testing.T, server *httptest.Server, token string) *websocket.Conn {
+	return dialWebSocketWith(t, server, func(config *websocket.Config) {
+		config.Header.Set("Authorization", "Bearer "+token)
+	})
+}
+
+func dialWebSocketWith(t *testing.T, server *httptest.Server, configure func(*websocket.Config)) *websocket.Conn {
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(server.URL, "http"), server.URL)
+	if err != nil {
+		t.Fatalf("Failed to configure WebSocket: %v", err)
+	}
+	configure(config)
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func receive(t *testing.T, ws *websocket.Conn) wsReply {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reply wsReply
+	if err := websocket.JSON.Receive(ws, &reply); err != nil {
+		t.Fatalf("Failed to receive a reply: %v", err)
+	}
+	return reply
+}
+
+func TestWebSocketHandlerRequiresToken(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test")
+	orchestrator, _ := newTestOrchestrator()
+	token := loginToken(t, orchestrator)
+
+	tt := []struct {
+		name     string
+		target   string
+		header   string
+		protocol string
+	}{
+		{"No Token", "/api/v1/ws", "", ""},
+		{"Query Token", "/api/v1/ws?token=" + token, "", ""},
+		{"Malformed Header", "/api/v1/ws", "Token " + token, ""},
+		{"Invalid Token", "/api/v1/ws", "Bearer invalid", ""},
+		{"Protocol Without Token", "/api/v1/ws", "", "bearer"},
+		{"Unknown Protocol", "/api/v1/ws", "", "token, " + token},
+		{"Invalid Protocol Token", "/api/v1/ws", "", "bearer, invalid"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			if tc.protocol != "" {
+				req.Header.Set("Sec-WebSocket-Protocol", tc.protocol)
+			}
+			rr := httptest.NewRecorder()
+			orchestrator.WebSocketHandler(rr, req)
+			if rr.Code != http.StatusUnauthorized {
+				t.Fatalf("Expected status code %d, but got %d", http.StatusUnauthorized, rr.Code)
+			}
+		})
+	}
+}
+
+func TestWebSocketHandlerMultiplexesRequests(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test")
+	orchestrator, _ := newTestOrchestrator()
+	startJobs(t, orchestrator, 2, 10)
+	server := httptest.NewServer(http.HandlerFunc(orchestrator.WebSocketHandler))
+	defer server.Close()
+	ws := dialWebSocket(t, server, loginToken(t, orchestrator))
+
+	for _, msg := range []string{
+		`{"id":"a","type":"calculate","expression":"x*(2+2)","variables":{"x":5}}`,
+		`{"id":"b","type":"calculate","expression":"2+*"}`,
+		`{"id":"c","type":"calculate","expression":"3*3"}`,
+	} {
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			t.Fatalf("Failed to send %s: %v", msg, err)
+		}
+	}
+
+	// ответы на разные запросы приходят вперемешку, их различают по id
+	expressions := make(map[string]string)
+	results := make(map[string]float64)
+	for len(results) < 2 || expressions["b"] == "" {
+		reply := receive(t, ws)
+		switch reply.Type {
+		case "accepted":
+			expressions[reply.ID] = reply.ExpressionID
+		case "error":
+			if reply.ID != "b" || reply.Code != http.StatusUnprocessableEntity || reply.Error == "" {
+				t.Fatalf("Unexpected error reply: %+v", reply)
+			}
+			expressions["b"] = "rejected"
+		case "status":
+			if reply.ExpressionID != expressions[reply.ID] {
+				t.Fatalf("Status of expression %s came with request %s", reply.ExpressionID, reply.ID)
+			}
+		case "result":
+			if reply.ExpressionID != expressions[reply.ID] || reply.Status != "done" || reply.Result == nil {
+				t.Fatalf("Unexpected result reply: %+v", reply)
+			}
+			results[reply.ID] = *reply.Result
+		default:
+			t.Fatalf("Unexpected reply: %+v", reply)
+		}
+	}
+
+	if results["a"] != 20 || results["c"] != 9 {
+		t.Fatalf("Expected results 20 and 9, got %v", results)
+	}
+}
+
+func TestWebSocketHandlerAcceptsProtocolToken(t *testing.T) {
+	t.Setenv("JWT_SECRET", "test")
+	orchestrator, _ := newTestOrchestrator()
+	startJobs(t, orchestrator, 1, 10)
+	server := httptest.NewServer(http.HandlerFunc(orchestrator.WebSocketHandler))
+	defer server.Close()
+
+	// так токен передает браузер: new WebSocket(url, ["bearer", token])
+	token := loginToken(t, orchestrator)
+	ws := dialWebSocketWith(t, server, func(config *websocket.Config) {
+		config.Protocol = []string{"bearer", token}
+	})
+	if protocol := ws.Config().Protocol; len(protocol) != 1 || protocol[0] != "bearer" {
+		t.Fatalf("Expected the server to choose the bearer protocol, got %v", protocol)
+	}
+
+	if err := websocket.Message.Send(ws, `{"id":"a","type":"calculate","expression":"2+2"}`); err != nil {
+		t.Fatalf("Failed to send a request: %v", err)
+	}
+	for {
+		reply := receive(t, ws)
+		if reply.Type == "error" {
+			t.Fatalf("Unexpected error reply: %+v", reply)
+		}
+		if reply.Type == "result" {
+			if reply.Result == nil || *reply.Result != 4 {
+				t.Fatalf("Expected result 4, got %+v", reply)
+			}
+			return
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package auth
 
 import (
-	"database/sql"
 	"os"
 	"strconv"
 	"time"
@@ -17,7 +16,7 @@ type User struct {
 }
 
 type AuthService struct {
-	db        *sql.DB
+	users     UserStore
 	jwtSecret string
 }
 
@@ -26,42 +25,30 @@ type Claims struct {
 	jwt.RegisteredClaims
 }
 
-func NewAuthService(db *sql.DB) *AuthService {
+func NewAuthService(users UserStore) *AuthService {
 	return &AuthService{
-		db:        db,
+		users:     users,
 		jwtSecret: os.Getenv("JWT_SECRET"),
 	}
 }
 
 func (s *AuthService) RegisterUser(login, password string) error {
-	var count int
-	err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE login = ?", login).Scan(&count)
-	if err != nil {
-		return err
-	}
-	if count > 0 {
-		return ErrUserAlreadyExists
-	}
-
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
 
-	_, err = s.db.Exec("INSERT INTO users (login, password) VALUES(?, ?)", login, passwordHash)
-	return err
+	return s.users.CreateUser(login, passwordHash)
 }
 
 func (s *AuthService) LoginUser(login, password string) (string, error) {
-	var user User
-	err := s.db.QueryRow("SELECT id, login, password FROM users WHERE login = ?", login).Scan(
-		&user.ID, &user.Login, &user.Password)
+	user, err := s.users.GetUserByLogin(login)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return "", ErrInvalidCreds
-		}
 		return "", err
 	}
+	if user == nil {
+		return "", ErrInvalidCreds
+	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
 		return "", ErrInvalidCreds
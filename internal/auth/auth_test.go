@@ -7,9 +7,10 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/shzuzu/Go_Calculator/internal/auth"
+	"github.com/shzuzu/Go_Calculator/internal/database/database"
 )
 
-func setupTestDB(t *testing.T) (*sql.DB, func()) {
+func setupTestDB(t *testing.T) (*database.DB, func()) {
 	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
 		t.Fatalf("Failed to open in-memory database: %v", err)
@@ -26,7 +27,7 @@ func setupTestDB(t *testing.T) (*sql.DB, func()) {
 		t.Fatalf("Failed to create users table: %v", err)
 	}
 
-	return db, func() {
+	return database.NewDB(db, database.SQLite), func() {
 		db.Close()
 	}
 }
@@ -35,7 +36,22 @@ func TestRegisterAndLoginUser(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
-	authService := auth.NewAuthService(db)
+	stores := []struct {
+		name  string
+		users auth.UserStore
+	}{
+		{"sql", auth.NewSQLUserStore(db)},
+		{"memory", auth.NewMemoryUserStore()},
+	}
+	for _, tc := range stores {
+		t.Run(tc.name, func(t *testing.T) {
+			testRegisterAndLogin(t, tc.users)
+		})
+	}
+}
+
+func testRegisterAndLogin(t *testing.T, users auth.UserStore) {
+	authService := auth.NewAuthService(users)
 
 	err := authService.RegisterUser("testuser", "password123")
 	if err != nil {
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/shzuzu/Go_Calculator/internal/database/database"
+)
+
+// UserStore keeps registered users. CreateUser returns
+// ErrUserAlreadyExists for a taken login; GetUserByLogin returns nil if
+// there is no such user.
+type UserStore interface {
+	CreateUser(login string, passwordHash []byte) error
+	GetUserByLogin(login string) (*User, error)
+}
+
+var (
+	_ UserStore = (*SQLUserStore)(nil)
+	_ UserStore = (*MemoryUserStore)(nil)
+)
+
+// SQLUserStore keeps users in the users table.
+type SQLUserStore struct {
+	db *database.DB
+}
+
+func NewSQLUserStore(db *database.DB) *SQLUserStore {
+	return &SQLUserStore{db: db}
+}
+
+func (s *SQLUserStore) CreateUser(login string, passwordHash []byte) error {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE login = ?", login).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrUserAlreadyExists
+	}
+
+	_, err = s.db.Exec("INSERT INTO users (login, password) VALUES(?, ?)", login, string(passwordHash))
+	return err
+}
+
+func (s *SQLUserStore) GetUserByLogin(login string) (*User, error) {
+	var user User
+	err := s.db.QueryRow("SELECT id, login, password FROM users WHERE login = ?", login).Scan(
+		&user.ID, &user.Login, &user.Password)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// MemoryUserStore keeps users in memory, for tests and ephemeral runs.
+type MemoryUserStore struct {
+	mu     sync.Mutex
+	users  map[string]User
+	lastID int64
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: make(map[string]User)}
+}
+
+func (s *MemoryUserStore) CreateUser(login string, passwordHash []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[login]; ok {
+		return ErrUserAlreadyExists
+	}
+	s.lastID++
+	s.users[login] = User{ID: s.lastID, Login: login, Password: string(passwordHash)}
+	return nil
+}
+
+func (s *MemoryUserStore) GetUserByLogin(login string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[login]
+	if !ok {
+		return nil, nil
+	}
+	return &user, nil
+}
@@ -3,12 +3,33 @@ package database
 import (
 	"database/sql"
 	"log"
+	"strings"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func InitDB(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+// Open connects to the database without touching the schema. A dsn that
+// starts with postgres:// or postgresql:// selects PostgreSQL; anything
+// else is the path of an SQLite file, optionally prefixed with sqlite://.
+func Open(dsn string) (*DB, error) {
+	driver, dialect := "sqlite3", SQLite
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		driver, dialect = "postgres", Postgres
+	} else {
+		dsn = strings.TrimPrefix(dsn, "sqlite://")
+		// транзакции сразу берут блокировку на запись: иначе два воркера,
+		// прочитав одно задание, получают SQLITE_BUSY при обновлении
+		if !strings.Contains(dsn, "_txlock=") {
+			sep := "?"
+			if strings.Contains(dsn, "?") {
+				sep = "&"
+			}
+			dsn += sep + "_txlock=immediate"
+		}
+	}
+
+	db, err := sql.Open(driver, dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -18,6 +39,14 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		db.Close()
 		return nil, err
 	}
+	return NewDB(db, dialect), nil
+}
+
+func InitDB(dsn string) (*DB, error) {
+	db, err := Open(dsn)
+	if err != nil {
+		return nil, err
+	}
 
 	err = CreateTables(db)
 	if err != nil {
@@ -28,33 +57,16 @@ func InitDB(dbPath string) (*sql.DB, error) {
 
 }
 
-func CreateTables(db *sql.DB) error {
-	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		login TEXT NOT NULL UNIQUE,
-		password TEXT NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	)`)
+// CreateTables brings the schema up to date by applying the pending
+// migrations.
+func CreateTables(db *DB) error {
+	migrator, err := NewMigrator(db)
 	if err != nil {
-		log.Printf("Error while creating users table: %v", err)
 		return err
 	}
-
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS expressions (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER NOT NULL,
-		expression TEXT NOT NULL,
-		status TEXT NOT NULL,
-		result REAL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (user_id) REFERENCES users(id)
-	)`)
-	if err != nil {
-		log.Printf("Error creating expressions table: %v", err)
+	if _, err := migrator.Up(); err != nil {
+		log.Printf("Error migrating database: %v", err)
 		return err
 	}
-
 	return nil
-
 }
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialect covers the differences between the supported databases. Queries
+// are written with ? placeholders and rewritten for the database in use.
+type Dialect int
+
+const (
+	SQLite Dialect = iota
+	Postgres
+)
+
+func (d Dialect) String() string {
+	if d == Postgres {
+		return "postgres"
+	}
+	return "sqlite"
+}
+
+// Rebind rewrites ? placeholders as $1, $2, ... for PostgreSQL. Question
+// marks in string literals are left alone.
+func (d Dialect) Rebind(query string) string {
+	if d != Postgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// TimeArg converts t for comparison with a column filled by
+// CURRENT_TIMESTAMP. SQLite stores that as UTC text without a zone.
+func (d Dialect) TimeArg(t time.Time) any {
+	if d == Postgres {
+		return t
+	}
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// SkipLocked is appended to a SELECT that claims a row of table, so that
+// replicas sharing a PostgreSQL database skip rows claimed by others. SQLite
+// locks the whole database for a write transaction anyway.
+func (d Dialect) SkipLocked(table string) string {
+	if d == Postgres {
+		return " FOR UPDATE OF " + table + " SKIP LOCKED"
+	}
+	return ""
+}
+
+// DB is a database handle that rewrites queries for its dialect.
+type DB struct {
+	*sql.DB
+	Dialect Dialect
+}
+
+func NewDB(db *sql.DB, dialect Dialect) *DB {
+	return &DB{DB: db, Dialect: dialect}
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.DB.Exec(db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.DB.Query(db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...any) *sql.Row {
+	return db.DB.QueryRow(db.Dialect.Rebind(query), args...)
+}
+
+func (db *DB) Begin() (*Tx, error) {
+	tx, err := db.DB.BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, dialect: db.Dialect}, nil
+}
+
+// Tx is a transaction that rewrites queries for its dialect.
+type Tx struct {
+	*sql.Tx
+	dialect Dialect
+}
+
+// Dialect returns the dialect of the database the transaction runs in.
+func (tx *Tx) Dialect() Dialect {
+	return tx.dialect
+}
+
+func (tx *Tx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.Tx.Exec(tx.dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.Tx.Query(tx.dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.Tx.QueryRow(tx.dialect.Rebind(query), args...)
+}
+
+func (tx *Tx) Prepare(query string) (*sql.Stmt, error) {
+	return tx.Tx.Prepare(tx.dialect.Rebind(query))
+}
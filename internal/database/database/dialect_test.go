@@ -0,0 +1,37 @@
+package database_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/database/database"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		dialect  database.Dialect
+		query    string
+		expected string
+	}{
+		{database.SQLite, "SELECT * FROM users WHERE login = ?", "SELECT * FROM users WHERE login = ?"},
+		{database.Postgres, "SELECT * FROM users WHERE login = ?", "SELECT * FROM users WHERE login = $1"},
+		{database.Postgres, "UPDATE jobs SET status = ?, attempts = ? WHERE id = ?", "UPDATE jobs SET status = $1, attempts = $2 WHERE id = $3"},
+		{database.Postgres, "SELECT '?' FROM users WHERE id = ?", "SELECT '?' FROM users WHERE id = $1"},
+		{database.Postgres, "SELECT 1", "SELECT 1"},
+	}
+	for _, tc := range tests {
+		if got := tc.dialect.Rebind(tc.query); got != tc.expected {
+			t.Fatalf("%s: expected %q, got %q", tc.dialect, tc.expected, got)
+		}
+	}
+}
+
+func TestTimeArg(t *testing.T) {
+	moment := time.Date(2025, 3, 1, 15, 4, 5, 0, time.FixedZone("UTC+3", 3*60*60))
+	if got := database.SQLite.TimeArg(moment); got != "2025-03-01 12:04:05" {
+		t.Fatalf("Expected UTC text for SQLite, got %v", got)
+	}
+	if got, ok := database.Postgres.TimeArg(moment).(time.Time); !ok || !got.Equal(moment) {
+		t.Fatalf("Expected the time itself for PostgreSQL, got %v", got)
+	}
+}
@@ -0,0 +1,268 @@
+package database
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/sqlite/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+// Migration is a numbered schema change. Up applies it, Down reverts it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// LoadMigrations reads migrations named like 0001_name.up.sql and
+// 0001_name.down.sql from the root of fsys, ordered by version.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies migrations to a database and records them in the
+// schema_migrations table. Every migration runs in its own transaction, so
+// a failed one leaves the database as it was.
+type Migrator struct {
+	db         *DB
+	migrations []Migration
+}
+
+// NewMigrator returns a migrator with the migrations embedded in the binary
+// for the dialect of db.
+func NewMigrator(db *DB) (*Migrator, error) {
+	sub, err := fs.Sub(migrationFiles, "migrations/"+db.Dialect.String())
+	if err != nil {
+		return nil, err
+	}
+	return NewMigratorFS(db, sub)
+}
+
+// NewMigratorFS returns a migrator with the migrations found in fsys.
+func NewMigratorFS(db *DB, fsys fs.FS) (*Migrator, error) {
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations}, nil
+}
+
+func (m *Migrator) init() error {
+	_, err := m.db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		log.Printf("Error creating schema_migrations table: %v", err)
+	}
+	return err
+}
+
+// Version returns the latest applied migration or 0.
+func (m *Migrator) Version() (int, error) {
+	if err := m.init(); err != nil {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err := m.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	return int(version.Int64), err
+}
+
+// Up applies all pending migrations in order and returns how many were
+// applied.
+func (m *Migrator) Up() (int, error) {
+	legacy, err := m.legacy()
+	if err != nil {
+		return 0, err
+	}
+	current, err := m.Version()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, migration := range m.migrations {
+		if migration.Version <= current {
+			continue
+		}
+		err := m.apply(migration, func(tx *Tx) error {
+			if _, err := tx.Exec(migration.Up); err != nil {
+				return err
+			}
+			// первая миграция застает базу, созданную до миграций
+			if legacy && applied == 0 {
+				return upgradeLegacy(tx)
+			}
+			return nil
+		}, `INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, migration.Version, migration.Name)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		log.Printf("Applied migration %d_%s", migration.Version, migration.Name)
+		applied++
+	}
+	return applied, nil
+}
+
+// Down reverts the latest applied migration and returns its version, or 0
+// if there was nothing to revert.
+func (m *Migrator) Down() (int, error) {
+	current, err := m.Version()
+	if err != nil || current == 0 {
+		return 0, err
+	}
+
+	for _, migration := range m.migrations {
+		if migration.Version != current {
+			continue
+		}
+		if migration.Down == "" {
+			return 0, fmt.Errorf("migration %d_%s can't be reverted: no down script", migration.Version, migration.Name)
+		}
+		err := m.apply(migration, func(tx *Tx) error {
+			_, err := tx.Exec(migration.Down)
+			return err
+		}, `DELETE FROM schema_migrations WHERE version = ?`, migration.Version)
+		if err != nil {
+			return 0, fmt.Errorf("reverting migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+		log.Printf("Reverted migration %d_%s", migration.Version, migration.Name)
+		return current, nil
+	}
+	return 0, fmt.Errorf("applied migration %d is unknown to this build", current)
+}
+
+// apply runs a migration script and the bookkeeping statement in one
+// transaction.
+func (m *Migrator) apply(migration Migration, script func(*Tx) error, record string, args ...any) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := script(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// legacy reports whether the database was created before migrations
+// existed: it has tables but no schema_migrations. Only SQLite databases
+// predate migrations.
+func (m *Migrator) legacy() (bool, error) {
+	if m.db.Dialect != SQLite {
+		return false, nil
+	}
+	tracked, err := m.tableExists("schema_migrations")
+	if err != nil || tracked {
+		return false, err
+	}
+	return m.tableExists("expressions")
+}
+
+func (m *Migrator) tableExists(name string) (bool, error) {
+	var n int
+	err := m.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n)
+	return n > 0, err
+}
+
+// legacyColumns were added to existing tables before migrations existed.
+// The initial migration only creates missing tables, so old databases get
+// these columns from upgradeLegacy, along with jobs for the expressions
+// they left unfinished.
+var legacyColumns = []struct{ table, definition string }{
+	{"jobs", "callback_url TEXT"},
+	{"expressions", "error_message TEXT"},
+	{"expressions", "started_at TIMESTAMP"},
+	{"expressions", "completed_at TIMESTAMP"},
+	{"expression_events", "error_message TEXT"},
+}
+
+func upgradeLegacy(tx *Tx) error {
+	log.Println("Upgrading a database created before migrations")
+	for _, column := range legacyColumns {
+		name := strings.Fields(column.definition)[0]
+		var n int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, column.table, name).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := tx.Exec(`ALTER TABLE ` + column.table + ` ADD COLUMN ` + column.definition); err != nil {
+			return err
+		}
+	}
+
+	// выражения, начатые до появления заданий, иначе никто не досчитает
+	result, err := tx.Exec(`
+		INSERT INTO jobs (expression_id, status, next_attempt_at)
+		SELECT e.id, 'pending', CURRENT_TIMESTAMP FROM expressions e
+		WHERE e.status IN ('pending', 'computing')
+		  AND NOT EXISTS (SELECT 1 FROM jobs j WHERE j.expression_id = e.id)`)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Queued %d unfinished expressions", n)
+	}
+	return nil
+}
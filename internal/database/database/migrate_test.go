@@ -0,0 +1,182 @@
+package database_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/shzuzu/Go_Calculator/internal/database/database"
+	"github.com/shzuzu/Go_Calculator/internal/database/repo"
+)
+
+func openTestDB(t *testing.T) *database.DB {
+	db, err := database.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func tableExists(t *testing.T, db *database.DB, name string) bool {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`, name).Scan(&n)
+	if err != nil {
+		t.Fatalf("Failed to look up table %s: %v", name, err)
+	}
+	return n > 0
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	db := openTestDB(t)
+
+	migrator, err := database.NewMigrator(db)
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+
+	applied, err := migrator.Up()
+	if err != nil || applied == 0 {
+		t.Fatalf("Expected migrations to be applied, got %d, %v", applied, err)
+	}
+	version, err := migrator.Version()
+	if err != nil || version != applied {
+		t.Fatalf("Expected version %d, got %d, %v", applied, version, err)
+	}
+	for _, table := range []string{"users", "expressions", "jobs", "expression_events", "idempotency_keys"} {
+		if !tableExists(t, db, table) {
+			t.Fatalf("Expected table %s to exist", table)
+		}
+	}
+
+	if applied, err := migrator.Up(); err != nil || applied != 0 {
+		t.Fatalf("Expected nothing to apply, got %d, %v", applied, err)
+	}
+
+	for v := version; v > 0; v-- {
+		reverted, err := migrator.Down()
+		if err != nil || reverted != v {
+			t.Fatalf("Expected migration %d to be reverted, got %d, %v", v, reverted, err)
+		}
+	}
+	if tableExists(t, db, "expressions") {
+		t.Fatal("Expected expressions table to be dropped")
+	}
+	if reverted, err := migrator.Down(); err != nil || reverted != 0 {
+		t.Fatalf("Expected nothing to revert, got %d, %v", reverted, err)
+	}
+}
+
+func TestMigrateFailureIsRolledBack(t *testing.T) {
+	db := openTestDB(t)
+
+	fsys := fstest.MapFS{
+		"0001_first.up.sql":    {Data: []byte(`CREATE TABLE first (id INTEGER);`)},
+		"0001_first.down.sql":  {Data: []byte(`DROP TABLE first;`)},
+		"0002_broken.up.sql":   {Data: []byte(`CREATE TABLE second (id INTEGER); INSERT INTO missing VALUES (1);`)},
+		"0002_broken.down.sql": {Data: []byte(`DROP TABLE second;`)},
+		"README.md":            {Data: []byte(`not a migration`)},
+	}
+	migrator, err := database.NewMigratorFS(db, fsys)
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+
+	applied, err := migrator.Up()
+	if err == nil || applied != 1 {
+		t.Fatalf("Expected the second migration to fail after one was applied, got %d, %v", applied, err)
+	}
+	if version, _ := migrator.Version(); version != 1 {
+		t.Fatalf("Expected version 1, got %d", version)
+	}
+	// таблица из упавшей миграции не должна остаться
+	if !tableExists(t, db, "first") || tableExists(t, db, "second") {
+		t.Fatal("Expected only the first migration to take effect")
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{name: "missing up script", fsys: fstest.MapFS{"0001_a.down.sql": {Data: []byte(`SELECT 1;`)}}},
+		{name: "conflicting names", fsys: fstest.MapFS{
+			"0001_a.up.sql": {Data: []byte(`SELECT 1;`)},
+			"0001_b.up.sql": {Data: []byte(`SELECT 1;`)},
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := database.LoadMigrations(tc.fsys); err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+
+	migrations, err := database.LoadMigrations(fstest.MapFS{
+		"0010_later.up.sql": {Data: []byte(`SELECT 10;`)},
+		"0002_early.up.sql": {Data: []byte(`SELECT 2;`)},
+	})
+	if err != nil || len(migrations) != 2 || migrations[0].Version != 2 || migrations[1].Name != "later" {
+		t.Fatalf("Expected migrations ordered by version, got %+v, %v", migrations, err)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	db := openTestDB(t)
+
+	// схема до появления миграций
+	_, err := db.Exec(`
+	CREATE TABLE users (id INTEGER PRIMARY KEY AUTOINCREMENT, login TEXT NOT NULL UNIQUE, password TEXT NOT NULL, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+	CREATE TABLE expressions (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER NOT NULL, expression TEXT NOT NULL, status TEXT NOT NULL, result REAL, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+	INSERT INTO users (login, password) VALUES ('old', 'hash');
+	INSERT INTO expressions (user_id, expression, status, result) VALUES (1, '2+2', 'done', 4);
+	INSERT INTO expressions (user_id, expression, status) VALUES (1, '3+3', 'pending');
+	INSERT INTO expressions (user_id, expression, status) VALUES (1, '4+4', 'computing');`)
+	if err != nil {
+		t.Fatalf("Failed to create legacy schema: %v", err)
+	}
+
+	if err := database.CreateTables(db); err != nil {
+		t.Fatalf("Failed to migrate legacy database: %v", err)
+	}
+
+	var expression string
+	var completedAt sql.NullTime
+	err = db.QueryRow(`SELECT expression, completed_at FROM expressions WHERE id = 1`).Scan(&expression, &completedAt)
+	if err != nil || expression != "2+2" || completedAt.Valid {
+		t.Fatalf("Expected the old row with the new column, got %q, %v, %v", expression, completedAt, err)
+	}
+	if !tableExists(t, db, "jobs") {
+		t.Fatal("Expected missing tables to be created")
+	}
+
+	// незаконченные выражения получают задания, законченные — нет
+	rows, err := db.Query(`SELECT expression_id FROM jobs WHERE status = 'pending' AND next_attempt_at IS NOT NULL ORDER BY expression_id`)
+	if err != nil {
+		t.Fatalf("Failed to query jobs: %v", err)
+	}
+	defer rows.Close()
+	var queued []int64
+	for rows.Next() {
+		var id int64
+		rows.Scan(&id)
+		queued = append(queued, id)
+	}
+	if len(queued) != 2 || queued[0] != 2 || queued[1] != 3 {
+		t.Fatalf("Expected jobs for expressions 2 and 3, got %v", queued)
+	}
+
+	expressions := repo.NewRepository(db)
+	if job, err := expressions.ClaimJob(time.Minute); err != nil || job == nil || job.ExpressionID != 2 || job.Expression != "3+3" {
+		t.Fatalf("Expected the job of expression 2 to be claimed, got %+v, %v", job, err)
+	}
+	if ok, err := expressions.CancelExpression(3); err != nil || !ok {
+		t.Fatalf("Expected expression 3 to be cancelled, got %v, %v", ok, err)
+	}
+}
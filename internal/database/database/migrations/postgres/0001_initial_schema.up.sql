@@ -0,0 +1,75 @@
+CREATE TABLE IF NOT EXISTS users (
+	id BIGSERIAL PRIMARY KEY,
+	login TEXT NOT NULL UNIQUE,
+	password TEXT NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS expressions (
+	id BIGSERIAL PRIMARY KEY,
+	user_id BIGINT NOT NULL REFERENCES users(id),
+	expression TEXT NOT NULL,
+	status TEXT NOT NULL,
+	result DOUBLE PRECISION,
+	error_message TEXT,
+	started_at TIMESTAMPTZ,
+	completed_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_expressions_user_created ON expressions (user_id, created_at);
+
+CREATE TABLE IF NOT EXISTS tasks (
+	id BIGSERIAL PRIMARY KEY,
+	expression_id BIGINT NOT NULL REFERENCES expressions(id),
+	step INTEGER NOT NULL,
+	operation TEXT NOT NULL,
+	status TEXT NOT NULL,
+	result DOUBLE PRECISION,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS jobs (
+	id BIGSERIAL PRIMARY KEY,
+	expression_id BIGINT NOT NULL UNIQUE REFERENCES expressions(id),
+	variables TEXT,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	lease_expires_at TIMESTAMPTZ,
+	next_attempt_at TIMESTAMPTZ,
+	last_error TEXT,
+	callback_url TEXT,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS expression_events (
+	id BIGSERIAL PRIMARY KEY,
+	expression_id BIGINT NOT NULL REFERENCES expressions(id),
+	user_id BIGINT NOT NULL,
+	status TEXT NOT NULL,
+	result DOUBLE PRECISION,
+	error_message TEXT,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_expression_events_user ON expression_events (user_id, id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id BIGSERIAL PRIMARY KEY,
+	expression_id BIGINT NOT NULL REFERENCES expressions(id),
+	url TEXT NOT NULL,
+	attempt INTEGER NOT NULL,
+	status_code INTEGER,
+	error TEXT,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	user_id BIGINT NOT NULL,
+	key TEXT NOT NULL,
+	request_hash TEXT NOT NULL,
+	expression_id BIGINT NOT NULL REFERENCES expressions(id),
+	expires_at TIMESTAMPTZ NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (user_id, key)
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_jobs_callback_status;
+ALTER TABLE jobs DROP COLUMN callback_lease_expires_at;
+ALTER TABLE jobs DROP COLUMN callback_status;
@@ -0,0 +1,6 @@
+-- callback_status is NULL without a callback_url; otherwise 'pending' once
+-- the job is finished, 'sending' while leased and 'delivered' or 'failed'
+ALTER TABLE jobs ADD COLUMN callback_status TEXT;
+ALTER TABLE jobs ADD COLUMN callback_lease_expires_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_jobs_callback_status ON jobs (callback_status);
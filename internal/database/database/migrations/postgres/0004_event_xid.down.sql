@@ -0,0 +1 @@
+ALTER TABLE expression_events DROP COLUMN xid;
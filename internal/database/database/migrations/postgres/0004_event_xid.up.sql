@@ -0,0 +1,4 @@
+-- xid is the transaction that recorded the event. Readers return only the
+-- events of transactions older than every running one, so an event cannot
+-- become visible behind a cursor that has moved past it
+ALTER TABLE expression_events ADD COLUMN xid xid8 NOT NULL DEFAULT pg_current_xact_id();
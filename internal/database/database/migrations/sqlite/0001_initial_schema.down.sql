@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS expression_events;
+DROP TABLE IF EXISTS jobs;
+DROP TABLE IF EXISTS tasks;
+DROP TABLE IF EXISTS expressions;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,81 @@
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	login TEXT NOT NULL UNIQUE,
+	password TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS expressions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	expression TEXT NOT NULL,
+	status TEXT NOT NULL,
+	result REAL,
+	error_message TEXT,
+	started_at TIMESTAMP,
+	completed_at TIMESTAMP,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_expressions_user_created ON expressions (user_id, created_at);
+
+CREATE TABLE IF NOT EXISTS tasks (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	expression_id INTEGER NOT NULL,
+	step INTEGER NOT NULL,
+	operation TEXT NOT NULL,
+	status TEXT NOT NULL,
+	result REAL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (expression_id) REFERENCES expressions(id)
+);
+
+CREATE TABLE IF NOT EXISTS jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	expression_id INTEGER NOT NULL UNIQUE,
+	variables TEXT,
+	status TEXT NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	lease_expires_at TIMESTAMP,
+	next_attempt_at TIMESTAMP,
+	last_error TEXT,
+	callback_url TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (expression_id) REFERENCES expressions(id)
+);
+
+CREATE TABLE IF NOT EXISTS expression_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	expression_id INTEGER NOT NULL,
+	user_id INTEGER NOT NULL,
+	status TEXT NOT NULL,
+	result REAL,
+	error_message TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (expression_id) REFERENCES expressions(id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_expression_events_user ON expression_events (user_id, id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	expression_id INTEGER NOT NULL,
+	url TEXT NOT NULL,
+	attempt INTEGER NOT NULL,
+	status_code INTEGER,
+	error TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (expression_id) REFERENCES expressions(id)
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	user_id INTEGER NOT NULL,
+	key TEXT NOT NULL,
+	request_hash TEXT NOT NULL,
+	expression_id INTEGER NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (user_id, key),
+	FOREIGN KEY (expression_id) REFERENCES expressions(id)
+);
@@ -0,0 +1,4 @@
+-- lease_token is set by the worker that leased the job; updates of a
+-- leased job must present it, so a worker whose lease has expired cannot
+-- finish a job another worker has leased since
+ALTER TABLE jobs ADD COLUMN lease_token TEXT;
@@ -0,0 +1,139 @@
+package repo
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/shzuzu/Go_Calculator/internal/database/database"
+)
+
+// Event is a recorded state of an expression. Events of a user are ordered
+// by ID, so the last seen ID is enough to resume a stream.
+type Event struct {
+	ID int64 `json:"-"`
+	Expression
+}
+
+// recordEvent appends the current state of the expression to its events.
+// It runs in the transaction that changed the state.
+//
+// On PostgreSQL a transaction with a greater event ID may commit before
+// one with a smaller ID, and a reader that has already moved its cursor
+// past the greater ID would never see the smaller one. There the event ID
+// starts with the ID of the transaction, and readers skip the events of
+// transactions that are not older than every running one (committedEvents),
+// so IDs become visible in order. SQLite allows a single writer anyway.
+func recordEvent(tx *database.Tx, expressionID int64) error {
+	query := `
+		INSERT INTO expression_events (expression_id, user_id, status, result, error_message)
+		SELECT id, user_id, status, result, error_message FROM expressions WHERE id = ?`
+	if tx.Dialect() == database.Postgres {
+		// младшие биты только различают события одной транзакции:
+		// они становятся видны все сразу
+		query = `
+		INSERT INTO expression_events (id, expression_id, user_id, status, result, error_message)
+		SELECT (pg_current_xact_id()::text::bigint << 20) | (nextval('expression_events_id_seq') & 1048575),
+			id, user_id, status, result, error_message
+		FROM expressions WHERE id = ?`
+	}
+	_, err := tx.Exec(query, expressionID)
+	if err != nil {
+		log.Printf("Error recording event of expression %d: %v", expressionID, err)
+	}
+	return err
+}
+
+// committedEvents is appended to the conditions of a query on
+// expression_events ev. On PostgreSQL it leaves out the events of
+// transactions that started no earlier than the oldest running one, so a
+// cursor never moves past the events running transactions will commit.
+func committedEvents(d database.Dialect) string {
+	if d == database.Postgres {
+		return " AND ev.xid < pg_snapshot_xmin(pg_current_snapshot())"
+	}
+	return ""
+}
+
+// GetEventsAfter returns the user's events with IDs greater than afterID,
+// oldest first.
+func (r *Repository) GetEventsAfter(userID int64, afterID int64) ([]*Event, error) {
+	rows, err := r.db.Query(`
+		SELECT ev.id, e.id, e.user_id, e.expression, ev.status, ev.result, ev.error_message, e.created_at
+		FROM expression_events ev JOIN expressions e ON e.id = ev.expression_id
+		WHERE ev.user_id = ? AND ev.id > ?`+committedEvents(r.db.Dialect)+`
+		ORDER BY ev.id`,
+		userID, afterID,
+	)
+	if err != nil {
+		log.Printf("Error querying events: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*Event
+	for rows.Next() {
+		event := &Event{}
+		var resultNull sql.NullFloat64
+		var errorMessage sql.NullString
+
+		err := rows.Scan(&event.ID, &event.Expression.ID, &event.UserID, &event.Expression.Expression, &event.Status, &resultNull, &errorMessage, &event.CreatedAt)
+		if err != nil {
+			log.Printf("Error scanning event row: %v", err)
+			return nil, err
+		}
+
+		if resultNull.Valid {
+			val := resultNull.Float64
+			event.Result = &val
+		}
+		event.ErrorMessage = errorMessage.String
+
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating event rows: %v", err)
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// UsersWithEventsAfter returns the users that have events with IDs greater
+// than afterID and the greatest such ID, or afterID if there are none.
+func (r *Repository) UsersWithEventsAfter(afterID int64) ([]int64, int64, error) {
+	rows, err := r.db.Query(`
+		SELECT ev.user_id, MAX(ev.id) FROM expression_events ev
+		WHERE ev.id > ?`+committedEvents(r.db.Dialect)+`
+		GROUP BY ev.user_id`,
+		afterID,
+	)
+	if err != nil {
+		log.Printf("Error querying new events: %v", err)
+		return nil, afterID, err
+	}
+	defer rows.Close()
+
+	var users []int64
+	last := afterID
+	for rows.Next() {
+		var userID, id int64
+		if err := rows.Scan(&userID, &id); err != nil {
+			return nil, afterID, err
+		}
+		users = append(users, userID)
+		last = max(last, id)
+	}
+	return users, last, rows.Err()
+}
+
+// LastEventID returns the ID of the user's latest event or 0.
+func (r *Repository) LastEventID(userID int64) (int64, error) {
+	var id sql.NullInt64
+	err := r.db.QueryRow(`SELECT MAX(ev.id) FROM expression_events ev WHERE ev.user_id = ?`+committedEvents(r.db.Dialect), userID).Scan(&id)
+	if err != nil {
+		log.Printf("Error querying last event: %v", err)
+		return 0, err
+	}
+	return id.Int64, nil
+}
@@ -0,0 +1,79 @@
+package repo
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// IdempotencyKey remembers which expression a request with the key created,
+// so a retried request gets the same expression instead of a new one.
+type IdempotencyKey struct {
+	UserID       int64
+	Key          string
+	RequestHash  string
+	ExpressionID int64
+	ExpiresAt    time.Time
+}
+
+// GetIdempotencyKey returns the user's key or nil if it is unknown or has
+// expired.
+func (r *Repository) GetIdempotencyKey(userID int64, key string) (*IdempotencyKey, error) {
+	k := &IdempotencyKey{}
+	err := r.db.QueryRow(`
+		SELECT user_id, key, request_hash, expression_id, expires_at
+		FROM idempotency_keys WHERE user_id = ? AND key = ? AND expires_at > ?`,
+		userID, key, time.Now().UTC(),
+	).Scan(&k.UserID, &k.Key, &k.RequestHash, &k.ExpressionID, &k.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Error querying idempotency key: %v", err)
+		return nil, err
+	}
+	return k, nil
+}
+
+// CreateIdempotent stores a pending expression with its job like
+// CreateWithJob and records key for it in the same transaction. An expired
+// key with the same name is replaced.
+func (r *Repository) CreateIdempotent(userID int64, item NewExpression, key *IdempotencyKey) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	ids, err := createExpressions(tx, userID, []NewExpression{item})
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM idempotency_keys WHERE user_id = ? AND key = ? AND expires_at <= ?`,
+		userID, key.Key, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`INSERT INTO idempotency_keys (user_id, key, request_hash, expression_id, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		userID, key.Key, key.RequestHash, ids[0], key.ExpiresAt.UTC())
+	if err != nil {
+		log.Printf("Error storing idempotency key: %v", err)
+		return 0, err
+	}
+
+	key.UserID = userID
+	key.ExpressionID = ids[0]
+	return ids[0], tx.Commit()
+}
+
+// DeleteExpiredIdempotencyKeys removes the keys that expired before now and
+// returns how many were removed.
+func (r *Repository) DeleteExpiredIdempotencyKeys(now time.Time) (int64, error) {
+	result, err := r.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at <= ?`, now.UTC())
+	if err != nil {
+		log.Printf("Error deleting expired idempotency keys: %v", err)
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,304 @@
+package repo
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/database/database"
+)
+
+// Job is the durable unit of work for one expression. A job is "pending"
+// until a worker leases it, "leased" while it is being evaluated and
+// "done", "failed" or "cancelled" at the end. A lease that is not renewed in time
+// expires and the job can be claimed again. LeaseToken identifies the
+// lease of the worker that claimed the job.
+type Job struct {
+	ID           int64
+	ExpressionID int64
+	UserID       int64
+	Expression   string
+	Variables    map[string]float64
+	Status       string
+	Attempts     int
+	LastError    string
+	CallbackURL  string
+	LeaseToken   string
+}
+
+// newLeaseToken returns a random token for a new lease.
+func newLeaseToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// NewExpression is an expression to be stored by CreateBatch.
+type NewExpression struct {
+	Expression  string
+	Variables   map[string]float64
+	CallbackURL string
+}
+
+// CreateWithJob stores a pending expression together with its job, so an
+// expression is never left without work to do.
+func (r *Repository) CreateWithJob(userID int64, expression string, variables map[string]float64, callbackURL string) (int64, error) {
+	ids, err := r.CreateBatch(userID, []NewExpression{{Expression: expression, Variables: variables, CallbackURL: callbackURL}})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// CreateBatch stores pending expressions with their jobs in a single
+// transaction and returns their IDs in the same order.
+func (r *Repository) CreateBatch(userID int64, expressions []NewExpression) ([]int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	ids, err := createExpressions(tx, userID, expressions)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func createExpressions(tx *database.Tx, userID int64, expressions []NewExpression) ([]int64, error) {
+	exprStmt, err := tx.Prepare(`INSERT INTO expressions (user_id, expression, status) VALUES (?, ?, ?) RETURNING id`)
+	if err != nil {
+		return nil, err
+	}
+	defer exprStmt.Close()
+	jobStmt, err := tx.Prepare(`INSERT INTO jobs (expression_id, variables, status, next_attempt_at, callback_url) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return nil, err
+	}
+	defer jobStmt.Close()
+
+	now := time.Now().UTC()
+	ids := make([]int64, 0, len(expressions))
+	for _, item := range expressions {
+		vars, err := json.Marshal(item.Variables)
+		if err != nil {
+			return nil, err
+		}
+
+		var id int64
+		err = exprStmt.QueryRow(userID, item.Expression, "pending").Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR creating expression: %v", err)
+		}
+
+		_, err = jobStmt.Exec(id, string(vars), "pending", now, sql.NullString{String: item.CallbackURL, Valid: item.CallbackURL != ""})
+		if err != nil {
+			return nil, fmt.Errorf("ERROR creating job: %v", err)
+		}
+		if err := recordEvent(tx, id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ClaimJob leases the oldest job that is due: a pending job whose next
+// attempt has come or a leased job whose lease has expired. It returns nil
+// if there is nothing to do.
+func (r *Repository) ClaimJob(lease time.Duration) (*Job, error) {
+	now := time.Now().UTC()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	job := &Job{}
+	var vars sql.NullString
+	var lastError sql.NullString
+	var callbackURL sql.NullString
+	err = tx.QueryRow(`
+		SELECT j.id, j.expression_id, e.user_id, e.expression, j.variables, j.attempts, j.last_error, j.callback_url
+		FROM jobs j JOIN expressions e ON e.id = j.expression_id
+		WHERE (j.status = 'pending' AND j.next_attempt_at <= ?)
+		   OR (j.status = 'leased' AND j.lease_expires_at <= ?)
+		ORDER BY j.id LIMIT 1`+r.db.Dialect.SkipLocked("j"),
+		now, now,
+	).Scan(&job.ID, &job.ExpressionID, &job.UserID, &job.Expression, &vars, &job.Attempts, &lastError, &callbackURL)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Error claiming job: %v", err)
+		return nil, err
+	}
+
+	if vars.Valid && vars.String != "" {
+		if err := json.Unmarshal([]byte(vars.String), &job.Variables); err != nil {
+			return nil, fmt.Errorf("ERROR decoding variables of job %d: %v", job.ID, err)
+		}
+	}
+	job.LastError = lastError.String
+	job.CallbackURL = callbackURL.String
+	job.Attempts++
+	job.Status = "leased"
+	job.LeaseToken = newLeaseToken()
+
+	_, err = tx.Exec(`UPDATE jobs SET status = ?, attempts = ?, lease_expires_at = ?, lease_token = ? WHERE id = ?`,
+		job.Status, job.Attempts, now.Add(lease), job.LeaseToken, job.ID)
+	if err != nil {
+		return nil, err
+	}
+	// при повторных попытках started_at остается временем первого запуска
+	_, err = tx.Exec(`UPDATE expressions SET status = 'computing', started_at = COALESCE(started_at, ?) WHERE id = ?`, now, job.ExpressionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordEvent(tx, job.ExpressionID); err != nil {
+		return nil, err
+	}
+	return job, tx.Commit()
+}
+
+// RenewLease extends the lease of a job that is still being evaluated. It
+// reports false if the lease is lost: the job was cancelled or, after the
+// lease expired, claimed by another worker.
+func (r *Repository) RenewLease(id int64, leaseToken string, lease time.Duration) (bool, error) {
+	result, err := r.db.Exec(`UPDATE jobs SET lease_expires_at = ? WHERE id = ? AND status = 'leased' AND lease_token = ?`,
+		time.Now().UTC().Add(lease), id, leaseToken)
+	if err != nil {
+		log.Printf("Error renewing lease of job %d: %v", id, err)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RetryJob puts a leased job back to pending; it will be claimed again at
+// next. It reports false if the lease is lost, e.g. because the job was
+// cancelled.
+func (r *Repository) RetryJob(id int64, leaseToken string, next time.Time, lastError string) (bool, error) {
+	result, err := r.db.Exec(`
+		UPDATE jobs SET status = 'pending', lease_expires_at = NULL, lease_token = NULL, next_attempt_at = ?, last_error = ?
+		WHERE id = ? AND status = 'leased' AND lease_token = ?`,
+		next.UTC(), lastError, id, leaseToken)
+	if err != nil {
+		log.Printf("Error scheduling retry of job %d: %v", id, err)
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// CompleteJob finishes a leased job together with its expression, so a
+// crash cannot leave a finished job with an expression still "computing".
+// Without errorMessage the job is "done" and the expression gets result;
+// otherwise the job is "failed" and the expression is "error". A job with a
+// callback URL gets its callback queued for ClaimCallback. It reports false
+// and changes nothing if the lease is lost.
+func (r *Repository) CompleteJob(id int64, leaseToken string, result *float64, errorMessage string) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	jobStatus, status := "done", "done"
+	if errorMessage != "" {
+		jobStatus, status, result = "failed", "error", nil
+	}
+
+	var expressionID int64
+	err = tx.QueryRow(`
+		UPDATE jobs SET status = ?, lease_expires_at = NULL, lease_token = NULL, last_error = ?,
+			callback_status = CASE WHEN callback_url IS NULL THEN NULL ELSE 'pending' END
+		WHERE id = ? AND status = 'leased' AND lease_token = ? RETURNING expression_id`,
+		jobStatus, errorMessage, id, leaseToken).Scan(&expressionID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err == nil {
+		err = setStatus(tx, expressionID, status, result, errorMessage)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error completing job %d: %v", id, err)
+		return false, err
+	}
+	return true, nil
+}
+
+// CancelExpression marks an unfinished expression and its job as
+// "cancelled" and queues the callback of the job, if any. It reports false
+// if the job has already finished.
+func (r *Repository) CancelExpression(expressionID int64) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE jobs SET status = 'cancelled', lease_expires_at = NULL, lease_token = NULL,
+			callback_status = CASE WHEN callback_url IS NULL THEN NULL ELSE 'pending' END
+		WHERE expression_id = ? AND status IN ('pending', 'leased')`,
+		expressionID)
+	if err != nil {
+		log.Printf("Error cancelling job of expression %d: %v", expressionID, err)
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec(`UPDATE expressions SET status = 'cancelled', completed_at = ? WHERE id = ?`, time.Now().UTC(), expressionID)
+	if err != nil {
+		log.Printf("Error cancelling expression %d: %v", expressionID, err)
+		return false, err
+	}
+	if err := recordEvent(tx, expressionID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// RecoverJobs releases the job and callback leases held by a previous run
+// of the orchestrator and returns the number of jobs to be picked up again. A
+// PostgreSQL database may be shared with other orchestrators, whose leases
+// must not be taken away; there the leases of a previous run simply expire.
+func (r *Repository) RecoverJobs() (int, error) {
+	if r.db.Dialect == database.SQLite {
+		_, err := r.db.Exec(`UPDATE jobs SET status = 'pending', lease_expires_at = NULL, lease_token = NULL WHERE status = 'leased'`)
+		if err != nil {
+			return 0, err
+		}
+		_, err = r.db.Exec(`UPDATE jobs SET callback_status = 'pending', callback_lease_expires_at = NULL WHERE callback_status = 'sending'`)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return r.CountPendingJobs()
+}
+
+// CountPendingJobs returns the number of jobs waiting to be claimed.
+func (r *Repository) CountPendingJobs() (int, error) {
+	var n int
+	err := r.db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE status = 'pending'`).Scan(&n)
+	if err != nil {
+		log.Printf("Error counting pending jobs: %v", err)
+	}
+	return n, err
+}
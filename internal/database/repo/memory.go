@@ -0,0 +1,568 @@
+package repo
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryRepository is an ExpressionStore that keeps everything in memory.
+// It is meant for tests and ephemeral runs: the data is lost on exit.
+type MemoryRepository struct {
+	mu          sync.Mutex
+	expressions map[int64]*Expression
+	jobs        []*memoryJob
+	tasks       []*Task
+	events      []*Event
+	keys        map[memoryKey]*IdempotencyKey
+	deliveries  []*WebhookDelivery
+	lastID      struct{ expression, job, task, event, delivery int64 }
+}
+
+type memoryJob struct {
+	Job
+	nextAttemptAt  time.Time
+	leaseExpiresAt time.Time
+
+	callbackStatus         string
+	callbackLeaseExpiresAt time.Time
+}
+
+type memoryKey struct {
+	userID int64
+	key    string
+}
+
+var _ ExpressionStore = (*MemoryRepository)(nil)
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		expressions: make(map[int64]*Expression),
+		keys:        make(map[memoryKey]*IdempotencyKey),
+	}
+}
+
+// expression returns a copy of a stored expression, so callers never share
+// it with the store.
+func (r *MemoryRepository) expression(id int64) *Expression {
+	stored, ok := r.expressions[id]
+	if !ok {
+		return nil
+	}
+	expr := *stored
+	if expr.StartedAt != nil && expr.CompletedAt != nil {
+		ms := expr.CompletedAt.Sub(*expr.StartedAt).Milliseconds()
+		expr.DurationMs = &ms
+	}
+	return &expr
+}
+
+// recordEvent appends the current state of the expression to its events.
+func (r *MemoryRepository) recordEvent(id int64) {
+	expr, ok := r.expressions[id]
+	if !ok {
+		return
+	}
+	r.lastID.event++
+	r.events = append(r.events, &Event{ID: r.lastID.event, Expression: Expression{
+		ID:           expr.ID,
+		UserID:       expr.UserID,
+		Expression:   expr.Expression,
+		Status:       expr.Status,
+		Result:       expr.Result,
+		ErrorMessage: expr.ErrorMessage,
+		CreatedAt:    expr.CreatedAt,
+	}})
+}
+
+func (r *MemoryRepository) createExpression(userID int64, item NewExpression) int64 {
+	now := time.Now().UTC()
+	r.lastID.expression++
+	id := r.lastID.expression
+	r.expressions[id] = &Expression{
+		ID:         strconv.FormatInt(id, 10),
+		UserID:     userID,
+		Expression: item.Expression,
+		Status:     "pending",
+		CreatedAt:  now,
+	}
+
+	r.lastID.job++
+	r.jobs = append(r.jobs, &memoryJob{
+		Job: Job{
+			ID:           r.lastID.job,
+			ExpressionID: id,
+			UserID:       userID,
+			Expression:   item.Expression,
+			Variables:    maps.Clone(item.Variables),
+			Status:       "pending",
+			CallbackURL:  item.CallbackURL,
+		},
+		nextAttemptAt: now,
+	})
+	r.recordEvent(id)
+	return id
+}
+
+func (r *MemoryRepository) CreateWithJob(userID int64, expression string, variables map[string]float64, callbackURL string) (int64, error) {
+	ids, err := r.CreateBatch(userID, []NewExpression{{Expression: expression, Variables: variables, CallbackURL: callbackURL}})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+func (r *MemoryRepository) CreateBatch(userID int64, expressions []NewExpression) ([]int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make([]int64, 0, len(expressions))
+	for _, item := range expressions {
+		ids = append(ids, r.createExpression(userID, item))
+	}
+	return ids, nil
+}
+
+func (r *MemoryRepository) CreateIdempotent(userID int64, item NewExpression, key *IdempotencyKey) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := memoryKey{userID, key.Key}
+	if stored, ok := r.keys[k]; ok && stored.ExpiresAt.After(time.Now()) {
+		return 0, fmt.Errorf("idempotency key %q already exists", key.Key)
+	}
+
+	id := r.createExpression(userID, item)
+	key.UserID = userID
+	key.ExpressionID = id
+	stored := *key
+	r.keys[k] = &stored
+	return id, nil
+}
+
+func (r *MemoryRepository) GetByID(id int64) (*Expression, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.expression(id), nil
+}
+
+func (r *MemoryRepository) ListExpressions(userID int64, q ExpressionQuery) ([]*Expression, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// порядок как в SQL: по времени создания, затем по ID
+	type listed struct {
+		id   int64
+		expr *Expression
+	}
+	compare := func(a, b listed) int {
+		if c := a.expr.CreatedAt.Compare(b.expr.CreatedAt); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.id, b.id)
+	}
+	if !q.Ascending {
+		ascending := compare
+		compare = func(a, b listed) int { return ascending(b, a) }
+	}
+
+	var cursor *listed
+	if q.After != 0 {
+		expr, ok := r.expressions[q.After]
+		if !ok || expr.UserID != userID {
+			return nil, nil
+		}
+		cursor = &listed{q.After, expr}
+	}
+
+	var page []listed
+	for id, expr := range r.expressions {
+		item := listed{id, expr}
+		switch {
+		case expr.UserID != userID:
+		case q.Status != "" && expr.Status != q.Status:
+		case !q.CreatedAfter.IsZero() && expr.CreatedAt.Before(q.CreatedAfter):
+		case !q.CreatedBefore.IsZero() && !expr.CreatedAt.Before(q.CreatedBefore):
+		case cursor != nil && compare(item, *cursor) <= 0:
+		default:
+			page = append(page, item)
+		}
+	}
+	slices.SortFunc(page, compare)
+	if q.Limit > 0 && len(page) > q.Limit {
+		page = page[:q.Limit]
+	}
+
+	expressions := make([]*Expression, 0, len(page))
+	for _, item := range page {
+		expressions = append(expressions, r.expression(item.id))
+	}
+	return expressions, nil
+}
+
+func (r *MemoryRepository) UpdateStatus(id int64, status string, result *float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setStatus(id, status, result, "")
+	return nil
+}
+
+func (r *MemoryRepository) setStatus(id int64, status string, result *float64, errorMessage string) {
+	expr, ok := r.expressions[id]
+	if !ok {
+		return
+	}
+	expr.Status = status
+	if result != nil {
+		value := *result
+		expr.Result = &value
+	}
+	if errorMessage != "" {
+		expr.ErrorMessage = errorMessage
+	}
+	if finished(status) {
+		now := time.Now().UTC()
+		expr.CompletedAt = &now
+	}
+	r.recordEvent(id)
+}
+
+func (r *MemoryRepository) CancelExpression(expressionID int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cancelled := false
+	for _, job := range r.jobs {
+		if job.ExpressionID == expressionID && (job.Status == "pending" || job.Status == "leased") {
+			job.Status = "cancelled"
+			job.LeaseToken = ""
+			job.leaseExpiresAt = time.Time{}
+			if job.CallbackURL != "" {
+				job.callbackStatus = "pending"
+			}
+			cancelled = true
+		}
+	}
+	if !cancelled {
+		return false, nil
+	}
+
+	if expr, ok := r.expressions[expressionID]; ok {
+		now := time.Now().UTC()
+		expr.Status = "cancelled"
+		expr.CompletedAt = &now
+	}
+	r.recordEvent(expressionID)
+	return true, nil
+}
+
+func (r *MemoryRepository) ClaimJob(lease time.Duration) (*Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, job := range r.jobs {
+		due := job.Status == "pending" && !job.nextAttemptAt.After(now) ||
+			job.Status == "leased" && !job.leaseExpiresAt.After(now)
+		if !due {
+			continue
+		}
+
+		job.Attempts++
+		job.Status = "leased"
+		job.LeaseToken = newLeaseToken()
+		job.leaseExpiresAt = now.Add(lease)
+		if expr, ok := r.expressions[job.ExpressionID]; ok {
+			expr.Status = "computing"
+			if expr.StartedAt == nil {
+				expr.StartedAt = &now
+			}
+		}
+		r.recordEvent(job.ExpressionID)
+
+		claimed := job.Job
+		claimed.Variables = maps.Clone(job.Variables)
+		return &claimed, nil
+	}
+	return nil, nil
+}
+
+// leasedJob returns the job with the given ID if it is leased with
+// leaseToken.
+func (r *MemoryRepository) leasedJob(id int64, leaseToken string) *memoryJob {
+	for _, job := range r.jobs {
+		if job.ID == id && job.Status == "leased" && job.LeaseToken == leaseToken {
+			return job
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) RenewLease(id int64, leaseToken string, lease time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job := r.leasedJob(id, leaseToken)
+	if job == nil {
+		return false, nil
+	}
+	job.leaseExpiresAt = time.Now().UTC().Add(lease)
+	return true, nil
+}
+
+func (r *MemoryRepository) RetryJob(id int64, leaseToken string, next time.Time, lastError string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job := r.leasedJob(id, leaseToken)
+	if job == nil {
+		return false, nil
+	}
+	job.Status = "pending"
+	job.LeaseToken = ""
+	job.leaseExpiresAt = time.Time{}
+	job.nextAttemptAt = next.UTC()
+	job.LastError = lastError
+	return true, nil
+}
+
+func (r *MemoryRepository) CompleteJob(id int64, leaseToken string, result *float64, errorMessage string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job := r.leasedJob(id, leaseToken)
+	if job == nil {
+		return false, nil
+	}
+	jobStatus, status := "done", "done"
+	if errorMessage != "" {
+		jobStatus, status, result = "failed", "error", nil
+	}
+	job.Status = jobStatus
+	job.LeaseToken = ""
+	job.leaseExpiresAt = time.Time{}
+	job.LastError = errorMessage
+	if job.CallbackURL != "" {
+		job.callbackStatus = "pending"
+	}
+	r.setStatus(job.ExpressionID, status, result, errorMessage)
+	return true, nil
+}
+
+// RecoverJobs releases all leases: the data of a MemoryRepository belongs
+// to a single orchestrator.
+func (r *MemoryRepository) RecoverJobs() (int, error) {
+	r.mu.Lock()
+	for _, job := range r.jobs {
+		if job.Status == "leased" {
+			job.Status = "pending"
+			job.LeaseToken = ""
+			job.leaseExpiresAt = time.Time{}
+		}
+		if job.callbackStatus == "sending" {
+			job.callbackStatus = "pending"
+			job.callbackLeaseExpiresAt = time.Time{}
+		}
+	}
+	r.mu.Unlock()
+
+	return r.CountPendingJobs()
+}
+
+func (r *MemoryRepository) CountPendingJobs() (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, job := range r.jobs {
+		if job.Status == "pending" {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *MemoryRepository) CreateTasks(expressionID int64, operations []string) ([]int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make([]int64, 0, len(operations))
+	for step, operation := range operations {
+		r.lastID.task++
+		r.tasks = append(r.tasks, &Task{
+			ID:           r.lastID.task,
+			ExpressionID: expressionID,
+			Step:         step,
+			Operation:    operation,
+			Status:       "pending",
+		})
+		ids = append(ids, r.lastID.task)
+	}
+	return ids, nil
+}
+
+func (r *MemoryRepository) UpdateTaskStatus(id int64, status string, result *float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, task := range r.tasks {
+		if task.ID == id {
+			task.Status = status
+			if result != nil {
+				value := *result
+				task.Result = &value
+			}
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) GetTasksByExpressionID(expressionID int64) ([]*Task, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var tasks []*Task
+	for _, task := range r.tasks {
+		if task.ExpressionID == expressionID {
+			t := *task
+			tasks = append(tasks, &t)
+		}
+	}
+	slices.SortStableFunc(tasks, func(a, b *Task) int { return a.Step - b.Step })
+	return tasks, nil
+}
+
+func (r *MemoryRepository) GetEventsAfter(userID int64, afterID int64) ([]*Event, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var events []*Event
+	for _, event := range r.events {
+		if event.UserID == userID && event.ID > afterID {
+			e := *event
+			events = append(events, &e)
+		}
+	}
+	return events, nil
+}
+
+func (r *MemoryRepository) LastEventID(userID int64) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := len(r.events) - 1; i >= 0; i-- {
+		if r.events[i].UserID == userID {
+			return r.events[i].ID, nil
+		}
+	}
+	return 0, nil
+}
+
+func (r *MemoryRepository) UsersWithEventsAfter(afterID int64) ([]int64, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var users []int64
+	last := afterID
+	for _, event := range r.events {
+		if event.ID <= afterID {
+			continue
+		}
+		if !slices.Contains(users, event.UserID) {
+			users = append(users, event.UserID)
+		}
+		last = max(last, event.ID)
+	}
+	return users, last, nil
+}
+
+func (r *MemoryRepository) GetIdempotencyKey(userID int64, key string) (*IdempotencyKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.keys[memoryKey{userID, key}]
+	if !ok || !stored.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+	k := *stored
+	return &k, nil
+}
+
+func (r *MemoryRepository) DeleteExpiredIdempotencyKeys(now time.Time) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int64
+	for k, stored := range r.keys {
+		if !stored.ExpiresAt.After(now) {
+			delete(r.keys, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (r *MemoryRepository) RecordDelivery(d *WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastID.delivery++
+	delivery := *d
+	delivery.ID = r.lastID.delivery
+	delivery.CreatedAt = time.Now().UTC()
+	r.deliveries = append(r.deliveries, &delivery)
+	return nil
+}
+
+func (r *MemoryRepository) ClaimCallback(lease time.Duration) (*Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, job := range r.jobs {
+		due := job.callbackStatus == "pending" ||
+			job.callbackStatus == "sending" && !job.callbackLeaseExpiresAt.After(now)
+		if !due {
+			continue
+		}
+		job.callbackStatus = "sending"
+		job.callbackLeaseExpiresAt = now.Add(lease)
+
+		claimed := job.Job
+		claimed.Variables = maps.Clone(job.Variables)
+		return &claimed, nil
+	}
+	return nil, nil
+}
+
+func (r *MemoryRepository) FinishCallback(jobID int64, status string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, job := range r.jobs {
+		if job.ID == jobID && job.callbackStatus == "sending" {
+			job.callbackStatus = status
+			job.callbackLeaseExpiresAt = time.Time{}
+		}
+	}
+	return nil
+}
+
+// GetDeliveries returns the delivery log of an expression, oldest first.
+func (r *MemoryRepository) GetDeliveries(expressionID int64) ([]*WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var deliveries []*WebhookDelivery
+	for _, d := range r.deliveries {
+		if d.ExpressionID == expressionID {
+			delivery := *d
+			deliveries = append(deliveries, &delivery)
+		}
+	}
+	return deliveries, nil
+}
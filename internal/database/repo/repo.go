@@ -4,50 +4,103 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/database/database"
 )
 
 type Expression struct {
-	ID         string   `json:"id"`
-	UserID     int64    `json:"user_id"`
-	Expression string   `json:"expression"`
-	Status     string   `json:"status"`
-	Result     *float64 `json:"result"`
+	ID           string     `json:"id"`
+	UserID       int64      `json:"user_id"`
+	Expression   string     `json:"expression"`
+	Status       string     `json:"status"`
+	Result       *float64   `json:"result"`
+	ErrorMessage string     `json:"error_message,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	CompletedAt  *time.Time `json:"completed_at,omitempty"`
+	// DurationMs is the time from the start of the evaluation to its end
+	DurationMs *int64 `json:"duration_ms,omitempty"`
+}
+
+// expressionColumns are read by scanExpression, in this order.
+const expressionColumns = "id, user_id, expression, status, result, error_message, created_at, started_at, completed_at"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanExpression(row scanner) (*Expression, error) {
+	expr := &Expression{}
+	var resultNull sql.NullFloat64
+	var errorMessage sql.NullString
+	var startedAt, completedAt sql.NullTime
+	err := row.Scan(&expr.ID, &expr.UserID, &expr.Expression, &expr.Status, &resultNull,
+		&errorMessage, &expr.CreatedAt, &startedAt, &completedAt)
+	if err != nil {
+		return nil, err
+	}
+	if resultNull.Valid {
+		val := resultNull.Float64
+		expr.Result = &val
+	}
+	expr.ErrorMessage = errorMessage.String
+	if startedAt.Valid {
+		expr.StartedAt = &startedAt.Time
+	}
+	if completedAt.Valid {
+		expr.CompletedAt = &completedAt.Time
+	}
+	if expr.StartedAt != nil && expr.CompletedAt != nil {
+		ms := expr.CompletedAt.Sub(*expr.StartedAt).Milliseconds()
+		expr.DurationMs = &ms
+	}
+	return expr, nil
+}
+
+// finished reports whether status is final; completed_at is set then.
+func finished(status string) bool {
+	return status == "done" || status == "error" || status == "cancelled"
 }
 
 type Repository struct {
-	db *sql.DB
+	db *database.DB
 }
 
-func NewRepository(db *sql.DB) *Repository {
+func NewRepository(db *database.DB) *Repository {
 	return &Repository{db: db}
 }
 
 func (r *Repository) Create(userID int64, expression string) (int64, error) {
-	result, err := r.db.Exec(`INSERT INTO expressions (user_id, expression, status) VALUES (?, ?, ?)`,
-		userID, expression, "pending")
+	tx, err := r.db.Begin()
 	if err != nil {
-		return 0, fmt.Errorf("ERROR creating expression: %v", err)
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	id, err := result.LastInsertId()
+	var id int64
+	err = tx.QueryRow(`INSERT INTO expressions (user_id, expression, status) VALUES (?, ?, ?) RETURNING id`,
+		userID, expression, "pending").Scan(&id)
 	if err != nil {
+		return 0, fmt.Errorf("ERROR creating expression: %v", err)
+	}
+	if err := recordEvent(tx, id); err != nil {
 		return 0, err
 	}
-	return id, nil
+	return id, tx.Commit()
 
 }
 func (r *Repository) UpdateStatus(id int64, status string, result *float64) error {
-	var err error
-	if result == nil {
-		_, err = r.db.Exec(
-			"UPDATE expressions SET status = ? WHERE id = ?",
-			status, id,
-		)
-	} else {
-		_, err = r.db.Exec(
-			"UPDATE expressions SET status = ?, result = ? WHERE id = ?",
-			status, *result, id,
-		)
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = setStatus(tx, id, status, result, "")
+	if err == nil {
+		err = tx.Commit()
 	}
 
 	if err != nil {
@@ -58,14 +111,34 @@ func (r *Repository) UpdateStatus(id int64, status string, result *float64) erro
 	return nil
 }
 
-func (r *Repository) GetByID(id int64) (*Expression, error) {
-	expr := &Expression{}
-	var resultNull sql.NullFloat64
+// setStatus changes the status of an expression and records the event in
+// the transaction tx.
+func setStatus(tx *database.Tx, id int64, status string, result *float64, errorMessage string) error {
+	query := "UPDATE expressions SET status = ?"
+	args := []any{status}
+	if result != nil {
+		query += ", result = ?"
+		args = append(args, *result)
+	}
+	if errorMessage != "" {
+		query += ", error_message = ?"
+		args = append(args, errorMessage)
+	}
+	if finished(status) {
+		query += ", completed_at = ?"
+		args = append(args, time.Now().UTC())
+	}
+	if _, err := tx.Exec(query+" WHERE id = ?", append(args, id)...); err != nil {
+		return err
+	}
+	return recordEvent(tx, id)
+}
 
-	err := r.db.QueryRow(
-		"SELECT id, user_id, expression, status, result FROM expressions WHERE id = ?",
+func (r *Repository) GetByID(id int64) (*Expression, error) {
+	expr, err := scanExpression(r.db.QueryRow(
+		"SELECT "+expressionColumns+" FROM expressions WHERE id = ?",
 		id,
-	).Scan(&expr.ID, &expr.UserID, &expr.Expression, &expr.Status, &resultNull)
+	))
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -75,19 +148,63 @@ func (r *Repository) GetByID(id int64) (*Expression, error) {
 		return nil, err
 	}
 
-	if resultNull.Valid {
-		val := resultNull.Float64
-		expr.Result = &val
-	}
-
 	return expr, nil
 }
 
 func (r *Repository) GetByUserID(userID int64) ([]*Expression, error) {
-	rows, err := r.db.Query(
-		"SELECT id, user_id, expression, status, result FROM expressions WHERE user_id = ? ORDER BY created_at DESC",
-		userID,
-	)
+	return r.ListExpressions(userID, ExpressionQuery{})
+}
+
+// ExpressionQuery selects a page of a user's expressions. Zero values mean
+// no filter; Limit 0 means no limit.
+type ExpressionQuery struct {
+	Status        string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Ascending lists the oldest expressions first; by default the newest
+	// come first
+	Ascending bool
+	// After is the ID of the last expression of the previous page
+	After int64
+	Limit int
+}
+
+// ListExpressions returns the user's expressions that match q, ordered by
+// creation time and ID.
+func (r *Repository) ListExpressions(userID int64, q ExpressionQuery) ([]*Expression, error) {
+	where := []string{"user_id = ?"}
+	args := []any{userID}
+	if q.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, q.Status)
+	}
+	if !q.CreatedAfter.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, r.db.Dialect.TimeArg(q.CreatedAfter))
+	}
+	if !q.CreatedBefore.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, r.db.Dialect.TimeArg(q.CreatedBefore))
+	}
+
+	order, cmp := "DESC", "<"
+	if q.Ascending {
+		order, cmp = "ASC", ">"
+	}
+	if q.After != 0 {
+		// курсор — последнее выражение прошлой страницы: продолжаем после него
+		where = append(where, "(created_at, id) "+cmp+" (SELECT created_at, id FROM expressions WHERE id = ? AND user_id = ?)")
+		args = append(args, q.After, userID)
+	}
+
+	query := "SELECT " + expressionColumns + " FROM expressions WHERE " + strings.Join(where, " AND ") +
+		" ORDER BY created_at " + order + ", id " + order
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
 		log.Printf("Error querying expressions by user ID: %v", err)
 		return nil, err
@@ -96,20 +213,11 @@ func (r *Repository) GetByUserID(userID int64) ([]*Expression, error) {
 
 	var expressions []*Expression
 	for rows.Next() {
-		expr := &Expression{}
-		var resultNull sql.NullFloat64
-
-		err := rows.Scan(&expr.ID, &expr.UserID, &expr.Expression, &expr.Status, &resultNull)
+		expr, err := scanExpression(rows)
 		if err != nil {
 			log.Printf("Error scanning expression row: %v", err)
 			return nil, err
 		}
-
-		if resultNull.Valid {
-			val := resultNull.Float64
-			expr.Result = &val
-		}
-
 		expressions = append(expressions, expr)
 	}
 
@@ -1,43 +1,23 @@
 package repo_test
 
 import (
-	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
-
+	"github.com/shzuzu/Go_Calculator/internal/database/database"
 	"github.com/shzuzu/Go_Calculator/internal/database/repo"
 )
 
-func setupTestDB(t *testing.T) (*sql.DB, func()) {
-	db, err := sql.Open("sqlite3", ":memory:")
-	if err != nil {
-		t.Fatalf("Failed to open in-memory database: %v", err)
-	}
-
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		login TEXT NOT NULL UNIQUE,
-		password TEXT NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	)`)
-	if err != nil {
-		t.Fatalf("Failed to create users table: %v", err)
-	}
-
-	_, err = db.Exec(`
-	CREATE TABLE IF NOT EXISTS expressions (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER NOT NULL,
-		expression TEXT NOT NULL,
-		status TEXT NOT NULL,
-		result REAL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (user_id) REFERENCES users(id)
-	)`)
+// setupTestDB opens an SQLite database in a temporary file, brings it up to
+// date with the real migrations and adds a test user.
+func setupTestDB(t *testing.T) (*database.DB, func()) {
+	db, err := database.InitDB(filepath.Join(t.TempDir(), "test.db"))
 	if err != nil {
-		t.Fatalf("Failed to create expressions table: %v", err)
+		t.Fatalf("Failed to create test database: %v", err)
 	}
 
 	_, err = db.Exec("INSERT INTO users (login, password) VALUES (?, ?)", "testuser", "hashedpassword")
@@ -117,3 +97,505 @@ func TestExpressionRepository(t *testing.T) {
 		t.Fatalf("Expected expression '2+2', got '%s'", expressions[0].Expression)
 	}
 }
+
+func TestTaskRepository(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	repo := repo.NewRepository(db)
+
+	exprID, err := repo.Create(1, "(1+2)*3")
+	if err != nil {
+		t.Fatalf("Failed to create expression: %v", err)
+	}
+
+	ids, err := repo.CreateTasks(exprID, []string{"+", "*"})
+	if err != nil {
+		t.Fatalf("Failed to create tasks: %v", err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("Expected 2 task IDs, got %d", len(ids))
+	}
+
+	result := 3.0
+	if err := repo.UpdateTaskStatus(ids[0], "done", &result); err != nil {
+		t.Fatalf("Failed to update task status: %v", err)
+	}
+	if err := repo.UpdateTaskStatus(ids[1], "computing", nil); err != nil {
+		t.Fatalf("Failed to update task status: %v", err)
+	}
+
+	tasks, err := repo.GetTasksByExpressionID(exprID)
+	if err != nil {
+		t.Fatalf("Failed to get tasks: %v", err)
+	}
+	if len(tasks) != 2 {
+		t.Fatalf("Expected 2 tasks, got %d", len(tasks))
+	}
+	if tasks[0].Operation != "+" || tasks[0].Status != "done" || tasks[0].Result == nil || *tasks[0].Result != 3 {
+		t.Fatalf("Unexpected first task: %+v", tasks[0])
+	}
+	if tasks[1].Step != 1 || tasks[1].Status != "computing" || tasks[1].Result != nil {
+		t.Fatalf("Unexpected second task: %+v", tasks[1])
+	}
+}
+
+func TestJobRepository(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	repo := repo.NewRepository(db)
+
+	exprID, err := repo.CreateWithJob(1, "pi * r^2", map[string]float64{"r": 3}, "http://example.com/hook")
+	if err != nil {
+		t.Fatalf("Failed to create expression with job: %v", err)
+	}
+
+	job, err := repo.ClaimJob(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to claim job: %v", err)
+	}
+	if job == nil || job.ExpressionID != exprID || job.Expression != "pi * r^2" || job.Attempts != 1 {
+		t.Fatalf("Unexpected job: %+v", job)
+	}
+	if job.Variables["r"] != 3 {
+		t.Fatalf("Expected variable r = 3, got %v", job.Variables)
+	}
+	if job.CallbackURL != "http://example.com/hook" {
+		t.Fatalf("Expected callback URL to be stored, got %q", job.CallbackURL)
+	}
+
+	// пока аренда не истекла, задачу никто другой не получит
+	if other, err := repo.ClaimJob(time.Minute); err != nil || other != nil {
+		t.Fatalf("Expected no job to claim, got %+v, %v", other, err)
+	}
+
+	if ok, err := repo.RetryJob(job.ID, job.LeaseToken, time.Now(), "unavailable"); err != nil || !ok {
+		t.Fatalf("Failed to schedule retry: %v", err)
+	}
+	job, err = repo.ClaimJob(-time.Second)
+	if err != nil || job == nil || job.Attempts != 2 || job.LastError != "unavailable" {
+		t.Fatalf("Unexpected retried job: %+v, %v", job, err)
+	}
+
+	// аренда истекла: задачу можно забрать снова
+	stale := job
+	job, err = repo.ClaimJob(time.Minute)
+	if err != nil || job == nil || job.Attempts != 3 || job.LeaseToken == stale.LeaseToken {
+		t.Fatalf("Expected expired lease to be claimed again, got %+v, %v", job, err)
+	}
+	// прежний владелец аренды больше ничего не меняет
+	if ok, err := repo.RenewLease(stale.ID, stale.LeaseToken, time.Minute); err != nil || ok {
+		t.Fatalf("Expected stale lease not to be renewed, got %v, %v", ok, err)
+	}
+	if ok, err := repo.RetryJob(stale.ID, stale.LeaseToken, time.Now(), "late"); err != nil || ok {
+		t.Fatalf("Expected stale lease not to be retried, got %v, %v", ok, err)
+	}
+	staleResult := 5.0
+	if ok, err := repo.CompleteJob(stale.ID, stale.LeaseToken, &staleResult, ""); err != nil || ok {
+		t.Fatalf("Expected stale lease not to be finished, got %v, %v", ok, err)
+	}
+	if ok, err := repo.RenewLease(job.ID, job.LeaseToken, time.Minute); err != nil || !ok {
+		t.Fatalf("Failed to renew lease: %v, %v", ok, err)
+	}
+
+	n, err := repo.RecoverJobs()
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 recovered job, got %d, %v", n, err)
+	}
+	job, err = repo.ClaimJob(time.Minute)
+	if err != nil || job == nil || job.Attempts != 4 {
+		t.Fatalf("Expected recovered job to be claimed, got %+v, %v", job, err)
+	}
+
+	result := 4.0
+	if ok, err := repo.CompleteJob(job.ID, job.LeaseToken, &result, ""); err != nil || !ok {
+		t.Fatalf("Failed to complete job: %v", err)
+	}
+	if job, err := repo.ClaimJob(time.Minute); err != nil || job != nil {
+		t.Fatalf("Expected no job after finishing, got %+v, %v", job, err)
+	}
+	// доставку, прерванную перезапуском, забирают снова
+	if callback, err := repo.ClaimCallback(time.Minute); err != nil || callback == nil || callback.ID != job.ID {
+		t.Fatalf("Expected callback to be claimed, got %+v, %v", callback, err)
+	}
+	if _, err := repo.RecoverJobs(); err != nil {
+		t.Fatalf("Failed to recover jobs: %v", err)
+	}
+	if callback, err := repo.ClaimCallback(time.Minute); err != nil || callback == nil || callback.ID != job.ID {
+		t.Fatalf("Expected recovered callback to be claimed, got %+v, %v", callback, err)
+	}
+	// задание и выражение завершаются вместе
+	if expr, err := repo.GetByID(exprID); err != nil || expr.Status != "done" || *expr.Result != 4 || expr.CompletedAt == nil {
+		t.Fatalf("Expected finished expression, got %+v, %v", expr, err)
+	}
+	if ok, err := repo.CancelExpression(exprID); err != nil || ok {
+		t.Fatalf("Expected finished expression not to be cancelled, got %v, %v", ok, err)
+	}
+}
+
+func TestCancelExpression(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	repo := repo.NewRepository(db)
+
+	exprID, err := repo.CreateWithJob(1, "2+2", nil, "http://example.com/hook")
+	if err != nil {
+		t.Fatalf("Failed to create expression with job: %v", err)
+	}
+	job, err := repo.ClaimJob(time.Minute)
+	if err != nil || job == nil {
+		t.Fatalf("Failed to claim job: %+v, %v", job, err)
+	}
+
+	if ok, err := repo.CancelExpression(exprID); err != nil || !ok {
+		t.Fatalf("Failed to cancel expression: %v, %v", ok, err)
+	}
+	expr, err := repo.GetByID(exprID)
+	if err != nil || expr.Status != "cancelled" {
+		t.Fatalf("Expected status 'cancelled', got %+v, %v", expr, err)
+	}
+	// колбэк об отмене ставится в очередь вместе с ней
+	if callback, err := repo.ClaimCallback(time.Minute); err != nil || callback == nil || callback.ExpressionID != exprID {
+		t.Fatalf("Expected callback of the cancelled expression, got %+v, %v", callback, err)
+	}
+
+	// воркер, который держал задание, уже не может его завершить
+	result := 4.0
+	if ok, err := repo.CompleteJob(job.ID, job.LeaseToken, &result, ""); err != nil || ok {
+		t.Fatalf("Expected cancelled job not to be finished, got %v, %v", ok, err)
+	}
+	if expr, err := repo.GetByID(exprID); err != nil || expr.Status != "cancelled" || expr.Result != nil {
+		t.Fatalf("Expected expression to stay cancelled, got %+v, %v", expr, err)
+	}
+	if ok, err := repo.CancelExpression(exprID); err != nil || ok {
+		t.Fatalf("Expected second cancel to fail, got %v, %v", ok, err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	repo := repo.NewRepository(db)
+
+	exprID, err := repo.CreateWithJob(1, "2+2", nil, "")
+	if err != nil {
+		t.Fatalf("Failed to create expression with job: %v", err)
+	}
+	if _, err := repo.ClaimJob(time.Minute); err != nil {
+		t.Fatalf("Failed to claim job: %v", err)
+	}
+	result := 4.0
+	if err := repo.UpdateStatus(exprID, "done", &result); err != nil {
+		t.Fatalf("Failed to update status: %v", err)
+	}
+
+	events, err := repo.GetEventsAfter(1, 0)
+	if err != nil {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	statuses := []string{"pending", "computing", "done"}
+	if len(events) != len(statuses) {
+		t.Fatalf("Expected %d events, got %d", len(statuses), len(events))
+	}
+	for i, status := range statuses {
+		if events[i].Status != status {
+			t.Fatalf("Expected event %d to be %q, got %q", i, status, events[i].Status)
+		}
+	}
+	if events[2].Result == nil || *events[2].Result != 4 {
+		t.Fatalf("Expected result 4 in the last event, got %v", events[2].Result)
+	}
+
+	// курсор: только события после последнего увиденного
+	events, err = repo.GetEventsAfter(1, events[1].ID)
+	if err != nil || len(events) != 1 || events[0].Status != "done" {
+		t.Fatalf("Expected only the last event, got %v, %v", events, err)
+	}
+	last, err := repo.LastEventID(1)
+	if err != nil || last != events[0].ID {
+		t.Fatalf("Expected last event ID %d, got %d, %v", events[0].ID, last, err)
+	}
+	if events, err := repo.GetEventsAfter(2, 0); err != nil || len(events) != 0 {
+		t.Fatalf("Expected no events of another user, got %v, %v", events, err)
+	}
+}
+
+func TestCreateBatch(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	r := repo.NewRepository(db)
+
+	ids, err := r.CreateBatch(1, []repo.NewExpression{
+		{Expression: "1+1"},
+		{Expression: "x*2", Variables: map[string]float64{"x": 4}},
+		{Expression: "1+1"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create batch: %v", err)
+	}
+	if len(ids) != 3 || ids[0] >= ids[1] || ids[1] >= ids[2] {
+		t.Fatalf("Expected 3 increasing IDs, got %v", ids)
+	}
+
+	for i, expected := range []string{"1+1", "x*2", "1+1"} {
+		job, err := r.ClaimJob(time.Minute)
+		if err != nil || job == nil {
+			t.Fatalf("Failed to claim job %d: %+v, %v", i, job, err)
+		}
+		if job.ExpressionID != ids[i] || job.Expression != expected {
+			t.Fatalf("Expected job for expression %d %q, got %+v", ids[i], expected, job)
+		}
+	}
+}
+
+func TestWebhookDeliveries(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	r := repo.NewRepository(db)
+
+	exprID, err := r.CreateWithJob(1, "2+2", nil, "http://example.com/hook")
+	if err != nil {
+		t.Fatalf("Failed to create expression: %v", err)
+	}
+
+	attempts := []repo.WebhookDelivery{
+		{ExpressionID: exprID, URL: "http://example.com/hook", Attempt: 1, Error: "connection refused"},
+		{ExpressionID: exprID, URL: "http://example.com/hook", Attempt: 2, StatusCode: 200},
+	}
+	for i := range attempts {
+		if err := r.RecordDelivery(&attempts[i]); err != nil {
+			t.Fatalf("Failed to record delivery: %v", err)
+		}
+	}
+
+	deliveries, err := r.GetDeliveries(exprID)
+	if err != nil {
+		t.Fatalf("Failed to get deliveries: %v", err)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("Expected 2 deliveries, got %d", len(deliveries))
+	}
+	if deliveries[0].StatusCode != 0 || deliveries[0].Error != "connection refused" {
+		t.Fatalf("Unexpected first delivery: %+v", deliveries[0])
+	}
+	if deliveries[1].Attempt != 2 || deliveries[1].StatusCode != 200 || deliveries[1].Error != "" {
+		t.Fatalf("Unexpected second delivery: %+v", deliveries[1])
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	r := repo.NewRepository(db)
+
+	if k, err := r.GetIdempotencyKey(1, "abc"); err != nil || k != nil {
+		t.Fatalf("Expected unknown key, got %+v, %v", k, err)
+	}
+
+	key := &repo.IdempotencyKey{Key: "abc", RequestHash: "hash", ExpiresAt: time.Now().Add(time.Hour)}
+	id, err := r.CreateIdempotent(1, repo.NewExpression{Expression: "2+2"}, key)
+	if err != nil {
+		t.Fatalf("Failed to create expression: %v", err)
+	}
+
+	k, err := r.GetIdempotencyKey(1, "abc")
+	if err != nil || k == nil || k.ExpressionID != id || k.RequestHash != "hash" {
+		t.Fatalf("Unexpected key: %+v, %v", k, err)
+	}
+	if k, err := r.GetIdempotencyKey(2, "abc"); err != nil || k != nil {
+		t.Fatalf("Expected keys to be per user, got %+v, %v", k, err)
+	}
+
+	// живой ключ нельзя использовать для второго выражения
+	if _, err := r.CreateIdempotent(1, repo.NewExpression{Expression: "3+3"}, &repo.IdempotencyKey{Key: "abc", RequestHash: "other", ExpiresAt: time.Now().Add(time.Hour)}); err == nil {
+		t.Fatal("Expected a duplicate key to be rejected")
+	}
+
+	if n, err := r.DeleteExpiredIdempotencyKeys(time.Now().Add(2 * time.Hour)); err != nil || n != 1 {
+		t.Fatalf("Expected 1 expired key, got %d, %v", n, err)
+	}
+	if k, err := r.GetIdempotencyKey(1, "abc"); err != nil || k != nil {
+		t.Fatalf("Expected expired key to be gone, got %+v, %v", k, err)
+	}
+}
+
+func TestListExpressions(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	r := repo.NewRepository(db)
+
+	var ids []int64
+	for i := 0; i < 5; i++ {
+		id, err := r.Create(1, fmt.Sprintf("%d+%d", i, i))
+		if err != nil {
+			t.Fatalf("Failed to create expression: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	if _, err := r.Create(2, "1+1"); err != nil {
+		t.Fatalf("Failed to create expression: %v", err)
+	}
+	result := 2.0
+	if err := r.UpdateStatus(ids[1], "done", &result); err != nil {
+		t.Fatalf("Failed to update status: %v", err)
+	}
+	if err := r.UpdateStatus(ids[3], "done", &result); err != nil {
+		t.Fatalf("Failed to update status: %v", err)
+	}
+
+	// все выражения созданы в одну секунду: порядок страниц держится на ID
+	pages := [][]int64{{ids[4], ids[3]}, {ids[2], ids[1]}, {ids[0]}, {}}
+	var after int64
+	for n, page := range pages {
+		expressions, err := r.ListExpressions(1, repo.ExpressionQuery{After: after, Limit: 2})
+		if err != nil {
+			t.Fatalf("Failed to list page %d: %v", n, err)
+		}
+		if len(expressions) != len(page) {
+			t.Fatalf("Expected %d expressions on page %d, got %d", len(page), n, len(expressions))
+		}
+		for i, expr := range expressions {
+			if expr.ID != strconv.FormatInt(page[i], 10) {
+				t.Fatalf("Expected expression %d at %d of page %d, got %s", page[i], i, n, expr.ID)
+			}
+			after = page[i]
+		}
+	}
+
+	tests := []struct {
+		name     string
+		query    repo.ExpressionQuery
+		expected []int64
+	}{
+		{name: "ascending", query: repo.ExpressionQuery{Ascending: true, After: ids[1], Limit: 2}, expected: []int64{ids[2], ids[3]}},
+		{name: "status", query: repo.ExpressionQuery{Status: "done"}, expected: []int64{ids[3], ids[1]}},
+		{name: "status after cursor", query: repo.ExpressionQuery{Status: "done", After: ids[3]}, expected: []int64{ids[1]}},
+		{name: "created before", query: repo.ExpressionQuery{CreatedBefore: time.Now().Add(-time.Hour)}, expected: nil},
+		{name: "created range", query: repo.ExpressionQuery{CreatedAfter: time.Now().Add(-time.Hour), CreatedBefore: time.Now().Add(time.Hour), Limit: 1}, expected: []int64{ids[4]}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			expressions, err := r.ListExpressions(1, tc.query)
+			if err != nil {
+				t.Fatalf("Failed to list expressions: %v", err)
+			}
+			if len(expressions) != len(tc.expected) {
+				t.Fatalf("Expected %d expressions, got %d", len(tc.expected), len(expressions))
+			}
+			for i, expr := range expressions {
+				if expr.ID != strconv.FormatInt(tc.expected[i], 10) {
+					t.Fatalf("Expected expression %d at %d, got %s", tc.expected[i], i, expr.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestExpressionLifecycle(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	r := repo.NewRepository(db)
+
+	exprID, err := r.CreateWithJob(1, "1/0", nil, "")
+	if err != nil {
+		t.Fatalf("Failed to create expression: %v", err)
+	}
+	expr, err := r.GetByID(exprID)
+	if err != nil || expr.StartedAt != nil || expr.CompletedAt != nil || expr.DurationMs != nil {
+		t.Fatalf("Expected a pending expression without timestamps, got %+v, %v", expr, err)
+	}
+
+	job, err := r.ClaimJob(time.Minute)
+	if err != nil || job == nil {
+		t.Fatalf("Failed to claim job: %+v, %v", job, err)
+	}
+	expr, err = r.GetByID(exprID)
+	if err != nil || expr.StartedAt == nil || expr.CompletedAt != nil {
+		t.Fatalf("Expected started_at to be set, got %+v, %v", expr, err)
+	}
+
+	if ok, err := r.CompleteJob(job.ID, job.LeaseToken, nil, "division by zero"); err != nil || !ok {
+		t.Fatalf("Failed to complete job with an error: %v", err)
+	}
+	expr, err = r.GetByID(exprID)
+	if err != nil {
+		t.Fatalf("Failed to get expression: %v", err)
+	}
+	if expr.Status != "error" || expr.ErrorMessage != "division by zero" {
+		t.Fatalf("Expected error with a message, got %+v", expr)
+	}
+	if expr.CompletedAt == nil || expr.CompletedAt.Before(*expr.StartedAt) {
+		t.Fatalf("Expected completed_at after started_at, got %v, %v", expr.StartedAt, expr.CompletedAt)
+	}
+	if expr.DurationMs == nil || *expr.DurationMs != expr.CompletedAt.Sub(*expr.StartedAt).Milliseconds() {
+		t.Fatalf("Unexpected duration %v", expr.DurationMs)
+	}
+
+	events, err := r.GetEventsAfter(1, 0)
+	if err != nil || len(events) == 0 {
+		t.Fatalf("Failed to get events: %v", err)
+	}
+	if last := events[len(events)-1]; last.Status != "error" || last.ErrorMessage != "division by zero" {
+		t.Fatalf("Expected the last event to carry the error, got %+v", last)
+	}
+}
+
+func TestClaimJobConcurrently(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	r := repo.NewRepository(db)
+	const jobs = 20
+	for i := 0; i < jobs; i++ {
+		if _, err := r.CreateWithJob(1, "2+2", nil, ""); err != nil {
+			t.Fatalf("Failed to create expression with job: %v", err)
+		}
+	}
+
+	// несколько воркеров разбирают задания одновременно: каждое достается одному
+	var mu sync.Mutex
+	claimed := make(map[int64]int)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, err := r.ClaimJob(time.Minute)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if job == nil {
+					return
+				}
+				mu.Lock()
+				claimed[job.ID]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("Failed to claim job: %v", err)
+	}
+	if len(claimed) != jobs {
+		t.Fatalf("Expected %d claimed jobs, got %d", jobs, len(claimed))
+	}
+	for id, n := range claimed {
+		if n != 1 {
+			t.Fatalf("Job %d was claimed %d times", id, n)
+		}
+	}
+}
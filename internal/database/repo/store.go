@@ -0,0 +1,39 @@
+package repo
+
+import "time"
+
+// ExpressionStore keeps expressions with their jobs, tasks, events and the
+// data attached to them. Repository implements it on top of SQL.
+type ExpressionStore interface {
+	CreateWithJob(userID int64, expression string, variables map[string]float64, callbackURL string) (int64, error)
+	CreateBatch(userID int64, expressions []NewExpression) ([]int64, error)
+	CreateIdempotent(userID int64, item NewExpression, key *IdempotencyKey) (int64, error)
+	GetByID(id int64) (*Expression, error)
+	ListExpressions(userID int64, q ExpressionQuery) ([]*Expression, error)
+	UpdateStatus(id int64, status string, result *float64) error
+	CancelExpression(expressionID int64) (bool, error)
+
+	ClaimJob(lease time.Duration) (*Job, error)
+	RenewLease(id int64, leaseToken string, lease time.Duration) (bool, error)
+	RetryJob(id int64, leaseToken string, next time.Time, lastError string) (bool, error)
+	CompleteJob(id int64, leaseToken string, result *float64, errorMessage string) (bool, error)
+	RecoverJobs() (int, error)
+	CountPendingJobs() (int, error)
+
+	CreateTasks(expressionID int64, operations []string) ([]int64, error)
+	UpdateTaskStatus(id int64, status string, result *float64) error
+	GetTasksByExpressionID(expressionID int64) ([]*Task, error)
+
+	GetEventsAfter(userID int64, afterID int64) ([]*Event, error)
+	LastEventID(userID int64) (int64, error)
+	UsersWithEventsAfter(afterID int64) ([]int64, int64, error)
+
+	GetIdempotencyKey(userID int64, key string) (*IdempotencyKey, error)
+	DeleteExpiredIdempotencyKeys(now time.Time) (int64, error)
+
+	ClaimCallback(lease time.Duration) (*Job, error)
+	FinishCallback(jobID int64, status string) error
+	RecordDelivery(d *WebhookDelivery) error
+}
+
+var _ ExpressionStore = (*Repository)(nil)
@@ -0,0 +1,183 @@
+package repo_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/auth"
+	"github.com/shzuzu/Go_Calculator/internal/database/repo"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	testStore(t, repo.NewRepository(db), auth.NewSQLUserStore(db))
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, repo.NewMemoryRepository(), auth.NewMemoryUserStore())
+}
+
+func TestMemoryStoreConcurrentEvents(t *testing.T) {
+	testConcurrentEvents(t, repo.NewMemoryRepository(), auth.NewMemoryUserStore())
+}
+
+// testStore runs an expression through the stores the way the orchestrator
+// does.
+func testStore(t *testing.T, r repo.ExpressionStore, users auth.UserStore) {
+	if err := users.CreateUser("store", []byte("hash")); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if err := users.CreateUser("store", []byte("hash")); err != auth.ErrUserAlreadyExists {
+		t.Fatalf("Expected ErrUserAlreadyExists, got %v", err)
+	}
+	user, err := users.GetUserByLogin("store")
+	if err != nil || user == nil || user.Password != "hash" {
+		t.Fatalf("Unexpected user: %+v, %v", user, err)
+	}
+
+	ids, err := r.CreateBatch(user.ID, []repo.NewExpression{
+		{Expression: "x+1", Variables: map[string]float64{"x": 1}, CallbackURL: "http://example.com/hook"},
+		{Expression: "2*3"},
+	})
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("Failed to create batch: %v, %v", ids, err)
+	}
+
+	job, err := r.ClaimJob(time.Minute)
+	if err != nil || job == nil || job.ExpressionID != ids[0] || job.Variables["x"] != 1 || job.CallbackURL == "" {
+		t.Fatalf("Unexpected job: %+v, %v", job, err)
+	}
+	if _, err := r.CreateTasks(job.ExpressionID, []string{"+"}); err != nil {
+		t.Fatalf("Failed to create tasks: %v", err)
+	}
+	result := 2.0
+	if ok, err := r.CompleteJob(job.ID, job.LeaseToken, &result, ""); err != nil || !ok {
+		t.Fatalf("Failed to complete job: %v", err)
+	}
+
+	expr, err := r.GetByID(ids[0])
+	if err != nil || expr.Status != "done" || *expr.Result != 2 || expr.DurationMs == nil {
+		t.Fatalf("Unexpected expression: %+v, %v", expr, err)
+	}
+
+	// обратный вызов выполненного задания ждет доставки; истекшую аренду забирают снова
+	callback, err := r.ClaimCallback(-time.Second)
+	if err != nil || callback == nil || callback.ID != job.ID || callback.CallbackURL != job.CallbackURL || callback.UserID != user.ID {
+		t.Fatalf("Unexpected callback: %+v, %v", callback, err)
+	}
+	if callback, err = r.ClaimCallback(time.Minute); err != nil || callback == nil || callback.ID != job.ID {
+		t.Fatalf("Expected expired callback lease to be claimed again, got %+v, %v", callback, err)
+	}
+	if again, err := r.ClaimCallback(time.Minute); err != nil || again != nil {
+		t.Fatalf("Expected a leased callback not to be claimed again, got %+v, %v", again, err)
+	}
+	if err := r.FinishCallback(callback.ID, "delivered"); err != nil {
+		t.Fatalf("Failed to finish callback: %v", err)
+	}
+	if again, err := r.ClaimCallback(0); err != nil || again != nil {
+		t.Fatalf("Expected no callback to deliver, got %+v, %v", again, err)
+	}
+
+	page, err := r.ListExpressions(user.ID, repo.ExpressionQuery{
+		CreatedAfter: time.Now().Add(-time.Hour), CreatedBefore: time.Now().Add(time.Hour), After: ids[1], Limit: 10,
+	})
+	if err != nil || len(page) != 1 || page[0].ID != strconv.FormatInt(ids[0], 10) {
+		t.Fatalf("Unexpected page: %v, %v", page, err)
+	}
+
+	if ok, err := r.CancelExpression(ids[1]); err != nil || !ok {
+		t.Fatalf("Failed to cancel expression: %v", err)
+	}
+	events, err := r.GetEventsAfter(user.ID, 0)
+	if err != nil || len(events) != 5 {
+		t.Fatalf("Expected 5 events, got %d, %v", len(events), err)
+	}
+	if _, last, err := r.UsersWithEventsAfter(0); err != nil || last != events[4].ID {
+		t.Fatalf("Expected last event %d, got %d, %v", events[4].ID, last, err)
+	}
+
+	key := &repo.IdempotencyKey{Key: "k", RequestHash: "h", ExpiresAt: time.Now().Add(time.Hour)}
+	if _, err := r.CreateIdempotent(user.ID, repo.NewExpression{Expression: "1+1"}, key); err != nil {
+		t.Fatalf("Failed to create idempotent expression: %v", err)
+	}
+	if k, err := r.GetIdempotencyKey(user.ID, "k"); err != nil || k == nil || k.ExpressionID != key.ExpressionID {
+		t.Fatalf("Unexpected key: %+v, %v", k, err)
+	}
+
+	if err := r.RecordDelivery(&repo.WebhookDelivery{ExpressionID: ids[0], URL: "http://example.com/hook", Attempt: 1, StatusCode: 200}); err != nil {
+		t.Fatalf("Failed to record delivery: %v", err)
+	}
+	if n, err := r.CountPendingJobs(); err != nil || n != 1 {
+		t.Fatalf("Expected 1 pending job, got %d, %v", n, err)
+	}
+}
+
+// testConcurrentEvents follows the events of a user with a cursor while
+// several writers change expressions, and checks that no event is skipped.
+func testConcurrentEvents(t *testing.T, r repo.ExpressionStore, users auth.UserStore) {
+	const writers, updates = 8, 50
+
+	if err := users.CreateUser("events", []byte("hash")); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	user, err := users.GetUserByLogin("events")
+	if err != nil || user == nil {
+		t.Fatalf("Unexpected user: %+v, %v", user, err)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		id, err := r.CreateWithJob(user.ID, "1+1", nil, "")
+		if err != nil {
+			t.Fatalf("Failed to create expression: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				result := float64(i)
+				if err := r.UpdateStatus(id, "computing", &result); err != nil {
+					t.Errorf("Failed to update expression %d: %v", id, err)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// читатель двигает курсор так же, как поток событий
+	seen := make(map[int64]bool)
+	var cursor int64
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		events, err := r.GetEventsAfter(user.ID, cursor)
+		if err != nil {
+			t.Fatalf("Failed to read events: %v", err)
+		}
+		for _, event := range events {
+			seen[event.ID] = true
+			cursor = max(cursor, event.ID)
+		}
+	}
+
+	all, err := r.GetEventsAfter(user.ID, 0)
+	if err != nil || len(all) != writers*(updates+1) {
+		t.Fatalf("Expected %d events, got %d, %v", writers*(updates+1), len(all), err)
+	}
+	for _, event := range all {
+		if !seen[event.ID] {
+			t.Fatalf("Event %d was committed behind the cursor and skipped", event.ID)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package repo
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Task is a single operation of a decomposed expression. Step is the index
+// of the operation in the expression's plan.
+type Task struct {
+	ID           int64    `json:"id"`
+	ExpressionID int64    `json:"expression_id"`
+	Step         int      `json:"step"`
+	Operation    string   `json:"operation"`
+	Status       string   `json:"status"`
+	Result       *float64 `json:"result"`
+}
+
+// CreateTasks stores one pending task per operation in a single transaction
+// and returns their IDs in the same order.
+func (r *Repository) CreateTasks(expressionID int64, operations []string) ([]int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO tasks (expression_id, step, operation, status) VALUES (?, ?, ?, ?) RETURNING id`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	ids := make([]int64, 0, len(operations))
+	for step, operation := range operations {
+		var id int64
+		err := stmt.QueryRow(expressionID, step, operation, "pending").Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("ERROR creating task: %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (r *Repository) UpdateTaskStatus(id int64, status string, result *float64) error {
+	var err error
+	if result == nil {
+		_, err = r.db.Exec("UPDATE tasks SET status = ? WHERE id = ?", status, id)
+	} else {
+		_, err = r.db.Exec("UPDATE tasks SET status = ?, result = ? WHERE id = ?", status, *result, id)
+	}
+
+	if err != nil {
+		log.Printf("Error updating task status: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func (r *Repository) GetTasksByExpressionID(expressionID int64) ([]*Task, error) {
+	rows, err := r.db.Query(
+		"SELECT id, expression_id, step, operation, status, result FROM tasks WHERE expression_id = ? ORDER BY step",
+		expressionID,
+	)
+	if err != nil {
+		log.Printf("Error querying tasks by expression ID: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []*Task
+	for rows.Next() {
+		task := &Task{}
+		var resultNull sql.NullFloat64
+
+		err := rows.Scan(&task.ID, &task.ExpressionID, &task.Step, &task.Operation, &task.Status, &resultNull)
+		if err != nil {
+			log.Printf("Error scanning task row: %v", err)
+			return nil, err
+		}
+
+		if resultNull.Valid {
+			val := resultNull.Float64
+			task.Result = &val
+		}
+
+		tasks = append(tasks, task)
+	}
+
+	if err = rows.Err(); err != nil {
+		log.Printf("Error iterating task rows: %v", err)
+		return nil, err
+	}
+
+	return tasks, nil
+}
@@ -0,0 +1,107 @@
+package repo
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// WebhookDelivery is one attempt to post a finished expression to its
+// callback URL.
+type WebhookDelivery struct {
+	ID           int64
+	ExpressionID int64
+	URL          string
+	Attempt      int
+	StatusCode   int
+	Error        string
+	CreatedAt    time.Time
+}
+
+// RecordDelivery appends an attempt to the delivery log.
+func (r *Repository) RecordDelivery(d *WebhookDelivery) error {
+	_, err := r.db.Exec(`INSERT INTO webhook_deliveries (expression_id, url, attempt, status_code, error) VALUES (?, ?, ?, ?, ?)`,
+		d.ExpressionID, d.URL, d.Attempt,
+		sql.NullInt64{Int64: int64(d.StatusCode), Valid: d.StatusCode != 0},
+		sql.NullString{String: d.Error, Valid: d.Error != ""})
+	if err != nil {
+		log.Printf("Error recording webhook delivery of expression %d: %v", d.ExpressionID, err)
+	}
+	return err
+}
+
+// ClaimCallback leases the callback of the oldest finished job that still
+// has to be delivered: a pending callback or one whose lease has expired.
+// It returns nil if there is nothing to deliver.
+func (r *Repository) ClaimCallback(lease time.Duration) (*Job, error) {
+	now := time.Now().UTC()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	job := &Job{}
+	err = tx.QueryRow(`
+		SELECT j.id, j.expression_id, e.user_id, j.status, j.callback_url
+		FROM jobs j JOIN expressions e ON e.id = j.expression_id
+		WHERE j.callback_status = 'pending'
+		   OR (j.callback_status = 'sending' AND j.callback_lease_expires_at <= ?)
+		ORDER BY j.id LIMIT 1`+r.db.Dialect.SkipLocked("j"),
+		now,
+	).Scan(&job.ID, &job.ExpressionID, &job.UserID, &job.Status, &job.CallbackURL)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Error claiming callback: %v", err)
+		return nil, err
+	}
+
+	_, err = tx.Exec(`UPDATE jobs SET callback_status = 'sending', callback_lease_expires_at = ? WHERE id = ?`,
+		now.Add(lease), job.ID)
+	if err != nil {
+		return nil, err
+	}
+	return job, tx.Commit()
+}
+
+// FinishCallback ends a claimed callback as "delivered" or "failed".
+func (r *Repository) FinishCallback(jobID int64, status string) error {
+	_, err := r.db.Exec(`UPDATE jobs SET callback_status = ?, callback_lease_expires_at = NULL WHERE id = ? AND callback_status = 'sending'`,
+		status, jobID)
+	if err != nil {
+		log.Printf("Error finishing callback of job %d: %v", jobID, err)
+	}
+	return err
+}
+
+// GetDeliveries returns the delivery log of an expression, oldest first.
+func (r *Repository) GetDeliveries(expressionID int64) ([]*WebhookDelivery, error) {
+	rows, err := r.db.Query(`
+		SELECT id, expression_id, url, attempt, status_code, error, created_at
+		FROM webhook_deliveries WHERE expression_id = ? ORDER BY id`,
+		expressionID,
+	)
+	if err != nil {
+		log.Printf("Error querying webhook deliveries: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		d := &WebhookDelivery{}
+		var statusCode sql.NullInt64
+		var deliveryErr sql.NullString
+		if err := rows.Scan(&d.ID, &d.ExpressionID, &d.URL, &d.Attempt, &statusCode, &deliveryErr, &d.CreatedAt); err != nil {
+			log.Printf("Error scanning webhook delivery row: %v", err)
+			return nil, err
+		}
+		d.StatusCode = int(statusCode.Int64)
+		d.Error = deliveryErr.String
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
@@ -3,44 +3,105 @@ package grpc
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/shzuzu/Go_Calculator/pkg/api"
 	"github.com/shzuzu/Go_Calculator/pkg/calc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
+// validationErrors maps error texts sent by the server back to calc errors.
+var validationErrors = map[string]error{
+	calc.ErrDivisionByZero.Error():    calc.ErrDivisionByZero,
+	calc.ErrModuloByZero.Error():      calc.ErrModuloByZero,
+	calc.ErrIntDivisionByZero.Error(): calc.ErrIntDivisionByZero,
+	calc.ErrInvalidPower.Error():      calc.ErrInvalidPower,
+	calc.ErrEOF.Error():               calc.ErrEOF,
+	calc.ErrUnknownFunction.Error():   calc.ErrUnknownFunction,
+	calc.ErrArgumentCount.Error():     calc.ErrArgumentCount,
+	calc.ErrDomain.Error():            calc.ErrDomain,
+
+	calc.ErrUndefinedVariable.Error():    calc.ErrUndefinedVariable,
+	calc.ErrConstantAssignment.Error():   calc.ErrConstantAssignment,
+	calc.ErrAssignmentNotAllowed.Error(): calc.ErrAssignmentNotAllowed,
+}
+
+// CalculatorClient talks to one or more calc servers. Calls are spread
+// over the servers in round-robin order.
 type CalculatorClient struct {
-	client pb.CalculatorServiceClient
-	conn   *grpc.ClientConn
+	clients []pb.CalculatorServiceClient
+	conns   []*grpc.ClientConn
+	next    atomic.Uint64
 }
 
-func NewCalculatorClient(address string) (*CalculatorClient, error) {
-	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		log.Fatalf("Failed to connect to gRPC server: %v", err)
-		return nil, err
+func NewCalculatorClient(addresses ...string) (*CalculatorClient, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("no calc server addresses")
+	}
+
+	c := &CalculatorClient{}
+	for _, address := range addresses {
+		conn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			log.Printf("Failed to connect to gRPC server %s: %v", address, err)
+			c.Close()
+			return nil, err
+		}
+		log.Printf("Using gRPC calculator server %s", address)
+		c.conns = append(c.conns, conn)
+		c.clients = append(c.clients, pb.NewCalculatorServiceClient(conn))
+	}
+	return c, nil
+}
+
+// WaitReady waits until every calc server accepts connections, so a server
+// that was never started is reported at startup rather than on the first
+// expression.
+func (c *CalculatorClient) WaitReady(ctx context.Context) error {
+	for _, conn := range c.conns {
+		conn.Connect()
+		for state := conn.GetState(); state != connectivity.Ready; state = conn.GetState() {
+			if !conn.WaitForStateChange(ctx, state) {
+				return fmt.Errorf("calc server %s is not reachable: %w", conn.Target(), ctx.Err())
+			}
+		}
 	}
+	return nil
+}
 
-	client := pb.NewCalculatorServiceClient(conn)
-	return &CalculatorClient{
-		client: client,
-		conn:   conn,
-	}, nil
+// Servers returns the number of calc servers the client is connected to.
+func (c *CalculatorClient) Servers() int {
+	return len(c.clients)
+}
+
+func (c *CalculatorClient) client() pb.CalculatorServiceClient {
+	n := c.next.Add(1) - 1
+	return c.clients[n%uint64(len(c.clients))]
 }
 
 func (c *CalculatorClient) Close() error {
-	return c.conn.Close()
+	var firstErr error
+	for _, conn := range c.conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
-func (c *CalculatorClient) Calculate(expression string) (float64, error) {
+func (c *CalculatorClient) Calculate(expression string, variables map[string]float64) (float64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	response, err := c.client.Calculate(ctx, &pb.CalculateRequest{
+	response, err := c.client().Calculate(ctx, &pb.CalculateRequest{
 		Expression: expression,
+		Variables:  variables,
 	})
 
 	if err != nil {
@@ -55,12 +116,31 @@ func (c *CalculatorClient) Calculate(expression string) (float64, error) {
 	return response.Result, nil
 }
 
-func (c *CalculatorClient) ValidateExpression(expression string) error {
+func (c *CalculatorClient) Compute(ctx context.Context, operation string, args []float64) (float64, error) {
+	response, err := c.client().Compute(ctx, &pb.ComputeRequest{
+		Operation: operation,
+		Args:      args,
+	})
+
+	if err != nil {
+		log.Printf("Failed to compute %s: %v", operation, err)
+		return 0, err
+	}
+
+	if response.Error != "" {
+		return 0, errors.New(response.Error)
+	}
+
+	return response.Result, nil
+}
+
+func (c *CalculatorClient) ValidateExpression(expression string, variables map[string]float64) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	response, err := c.client.ValidateExpression(ctx, &pb.ValidateRequest{
+	response, err := c.client().ValidateExpression(ctx, &pb.ValidateRequest{
 		Expression: expression,
+		Variables:  variables,
 	})
 
 	if err != nil {
@@ -69,13 +149,30 @@ func (c *CalculatorClient) ValidateExpression(expression string) error {
 	}
 
 	if !response.IsValid {
-		if response.Error == "division by zero" {
-			return calc.ErrDivisionByZero
-		} else if response.Error == "EOF" {
-			return calc.ErrEOF
-		} else {
-			return calc.ErrInvalidExpression
+		if response.Position != nil {
+			return &calc.SyntaxError{
+				Expression: expression,
+				Offset:     int(response.GetPosition()),
+				Token:      response.Token,
+				Expected:   response.Expected,
+			}
+		}
+		if response.Function != "" {
+			reason := strings.TrimPrefix(response.Error, response.Function+": ")
+			if err, ok := validationErrors[reason]; ok {
+				return &calc.FunctionError{Func: response.Function, Err: err}
+			}
+		}
+		if response.Variable != "" {
+			reason := strings.TrimPrefix(response.Error, response.Variable+": ")
+			if err, ok := validationErrors[reason]; ok {
+				return &calc.NameError{Name: response.Variable, Err: err}
+			}
+		}
+		if err, ok := validationErrors[response.Error]; ok {
+			return err
 		}
+		return calc.ErrInvalidExpression
 	}
 
 	return nil
@@ -2,22 +2,34 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net"
+	"sync"
 
 	pb "github.com/shzuzu/Go_Calculator/pkg/api"
 	"github.com/shzuzu/Go_Calculator/pkg/calc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
 )
 
 type CalculatorServer struct {
 	pb.UnimplementedCalculatorServiceServer
+	evaluator *calc.Evaluator
+}
+
+func NewCalculatorServer(evaluator *calc.Evaluator) *CalculatorServer {
+	return &CalculatorServer{evaluator: evaluator}
 }
 
 func (s *CalculatorServer) Calculate(ctx context.Context, req *pb.CalculateRequest) (*pb.CalculateResponse, error) {
 	log.Printf("Received calculation request: %s", req.Expression)
 
-	result, err := calc.Calc(req.Expression)
+	result, err := s.evaluator.EvalContext(ctx, req.Expression, req.Variables)
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		log.Printf("Calculation of %s stopped: %v", req.Expression, err)
+		return nil, status.FromContextError(err).Err()
+	}
 	response := &pb.CalculateResponse{
 		Result: result,
 	}
@@ -32,8 +44,7 @@ func (s *CalculatorServer) Calculate(ctx context.Context, req *pb.CalculateReque
 func (s *CalculatorServer) ValidateExpression(ctx context.Context, req *pb.ValidateRequest) (*pb.ValidateResponse, error) {
 	log.Printf("Received validation request: %s", req.Expression)
 
-	wp := calc.NewWorkerPool(1)
-	err := wp.ValidateExpression(req.Expression)
+	err := calc.Validate(req.Expression, req.Variables)
 
 	response := &pb.ValidateResponse{
 		IsValid: err == nil,
@@ -41,12 +52,79 @@ func (s *CalculatorServer) ValidateExpression(ctx context.Context, req *pb.Valid
 
 	if err != nil {
 		response.Error = err.Error()
+
+		var syntaxErr *calc.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			position := int32(syntaxErr.Offset)
+			response.Position = &position
+			response.Token = syntaxErr.Token
+			response.Expected = syntaxErr.Expected
+		}
+
+		var funcErr *calc.FunctionError
+		if errors.As(err, &funcErr) {
+			response.Function = funcErr.Func
+		}
+
+		var nameErr *calc.NameError
+		if errors.As(err, &nameErr) {
+			response.Variable = nameErr.Name
+		}
 	}
 
 	return response, nil
 }
 
-func StartServer(address string) error {
+func (s *CalculatorServer) Compute(ctx context.Context, req *pb.ComputeRequest) (*pb.ComputeResponse, error) {
+	log.Printf("Received compute request: %s %v", req.Operation, req.Args)
+
+	result, err := s.evaluator.Apply(ctx, req.Operation, req.Args)
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		log.Printf("Operation %s stopped: %v", req.Operation, err)
+		return nil, status.FromContextError(err).Err()
+	}
+	response := &pb.ComputeResponse{
+		Result: result,
+	}
+
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	return response, nil
+}
+
+// batchWorkers limits how many expressions of one batch are evaluated at
+// once.
+const batchWorkers = 16
+
+func (s *CalculatorServer) CalculateBatch(ctx context.Context, req *pb.CalculateBatchRequest) (*pb.CalculateBatchResponse, error) {
+	log.Printf("Received batch of %d calculations", len(req.Requests))
+
+	responses := make([]*pb.CalculateResponse, len(req.Requests))
+	errs := make([]error, len(req.Requests))
+	sem := make(chan struct{}, batchWorkers)
+	var wg sync.WaitGroup
+	for i, item := range req.Requests {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			responses[i], errs[i] = s.Calculate(ctx, item)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &pb.CalculateBatchResponse{Responses: responses}, nil
+}
+
+func StartServer(address string, evaluator *calc.Evaluator) error {
 	lis, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
@@ -54,7 +132,7 @@ func StartServer(address string) error {
 	}
 
 	server := grpc.NewServer()
-	pb.RegisterCalculatorServiceServer(server, &CalculatorServer{})
+	pb.RegisterCalculatorServiceServer(server, NewCalculatorServer(evaluator))
 
 	log.Printf("gRPC server listening on %s", address)
 	return server.Serve(lis)
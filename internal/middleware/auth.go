@@ -26,13 +26,12 @@ func AuthMiddleware(authService *auth.AuthService) func(http.Handler) http.Handl
 				return
 			}
 
-			tokenParts := strings.Split(authHeader, " ")
-			if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
+			token, ok := BearerToken(authHeader)
+			if !ok {
 				http.Error(w, "Invalid authorization format", http.StatusUnauthorized)
 				return
 			}
 
-			token := tokenParts[1]
 			userID, err := authService.ValidateToken(token)
 			if err != nil {
 				http.Error(w, "Invalid token", http.StatusUnauthorized)
@@ -45,6 +44,16 @@ func AuthMiddleware(authService *auth.AuthService) func(http.Handler) http.Handl
 	}
 }
 
+// BearerToken extracts the token from an "Authorization: Bearer <token>"
+// header value.
+func BearerToken(header string) (string, bool) {
+	tokenParts := strings.Split(header, " ")
+	if len(tokenParts) != 2 || tokenParts[0] != "Bearer" || tokenParts[1] == "" {
+		return "", false
+	}
+	return tokenParts[1], true
+}
+
 func GetUserID(ctx context.Context) (int64, bool) {
 	userID, ok := ctx.Value(UserIDKey).(int64)
 	return userID, ok
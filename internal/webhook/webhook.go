@@ -0,0 +1,191 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of the request body, formatted as
+// "sha256=<hex>".
+const SignatureHeader = "X-Signature-256"
+
+// Delivery describes one attempt to deliver a callback. Err is set when
+// the receiver could not be reached or answered with a non-2xx status.
+type Delivery struct {
+	URL        string
+	Attempt    int
+	StatusCode int
+	Err        error
+}
+
+// ErrForbiddenAddress is returned for callbacks to loopback, private,
+// link-local and other addresses that are not reachable from the internet.
+// They would let users make the server call its own network.
+var ErrForbiddenAddress = errors.New("callback address is not public")
+
+// forbiddenPrefixes are special ranges that netip has no predicate for.
+var forbiddenPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("198.18.0.0/15"), // benchmarking
+}
+
+// PublicAddr reports whether addr may receive callbacks.
+func PublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, prefix := range forbiddenPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sender posts signed JSON callbacks and retries failed deliveries with
+// exponential backoff. Unless AllowPrivate is set, its client refuses to
+// connect to addresses that are not public, whatever the host resolves to
+// at the time of the call.
+type Sender struct {
+	Secret       []byte
+	Client       *http.Client
+	MaxAttempts  int
+	BaseDelay    time.Duration
+	AllowPrivate bool
+}
+
+func NewSender(secret string) *Sender {
+	s := &Sender{
+		Secret:      []byte(secret),
+		MaxAttempts: 5,
+		BaseDelay:   time.Second,
+	}
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: s.checkDial}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// через прокси адрес получателя не проверить
+	transport.Proxy = nil
+	s.Client = &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	return s
+}
+
+// checkDial runs after the host is resolved, right before connecting.
+func (s *Sender) checkDial(network, address string, _ syscall.RawConn) error {
+	if s.AllowPrivate {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil || !PublicAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, address)
+	}
+	return nil
+}
+
+// CheckHost resolves host and fails with ErrForbiddenAddress if any of its
+// addresses is not public.
+func (s *Sender) CheckHost(ctx context.Context, host string) error {
+	if s.AllowPrivate {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !PublicAddr(addr) {
+			return fmt.Errorf("%w: %s", ErrForbiddenAddress, addr)
+		}
+	}
+	return nil
+}
+
+// Sign returns the signature of body in the SignatureHeader format.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature matches body.
+func Verify(secret, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// Send posts payload as JSON to url. Network errors, 429 and 5xx answers
+// are retried; other answers are final. onAttempt, if not nil, is called
+// after every attempt.
+func (s *Sender) Send(ctx context.Context, url string, payload any, onAttempt func(Delivery)) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	signature := Sign(s.Secret, body)
+
+	delay := s.BaseDelay
+	for attempt := 1; ; attempt++ {
+		delivery := s.post(ctx, url, body, signature)
+		delivery.Attempt = attempt
+		if onAttempt != nil {
+			onAttempt(delivery)
+		}
+		if delivery.Err == nil {
+			return nil
+		}
+		if !retryable(delivery) || attempt >= s.MaxAttempts {
+			return fmt.Errorf("delivery to %s failed after %d attempts: %w", url, attempt, delivery.Err)
+		}
+
+		log.Printf("webhook: attempt %d to %s failed, retrying in %v: %v", attempt, url, delay, delivery.Err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func (s *Sender) post(ctx context.Context, url string, body []byte, signature string) Delivery {
+	delivery := Delivery{URL: url}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		delivery.Err = err
+		return delivery
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		delivery.Err = err
+		return delivery
+	}
+	resp.Body.Close()
+
+	delivery.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		delivery.Err = fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return delivery
+}
+
+func retryable(d Delivery) bool {
+	if errors.Is(d.Err, ErrForbiddenAddress) {
+		return false
+	}
+	return d.StatusCode == 0 || d.StatusCode == http.StatusTooManyRequests || d.StatusCode >= 500
+}
@@ -0,0 +1,151 @@
+package webhook_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shzuzu/Go_Calculator/internal/webhook"
+)
+
+func TestSendRetriesAndSigns(t *testing.T) {
+	secret := []byte("secret")
+	var calls atomic.Int32
+	received := make(chan string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !webhook.Verify(secret, body, r.Header.Get(webhook.SignatureHeader)) {
+			t.Errorf("Invalid signature %q", r.Header.Get(webhook.SignatureHeader))
+		}
+		// первые две попытки получатель недоступен
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received <- string(body)
+	}))
+	defer server.Close()
+
+	sender := webhook.NewSender(string(secret))
+	sender.BaseDelay = time.Millisecond
+	// тестовый сервер слушает loopback
+	sender.AllowPrivate = true
+
+	var deliveries []webhook.Delivery
+	err := sender.Send(context.Background(), server.URL, map[string]string{"status": "done"}, func(d webhook.Delivery) {
+		deliveries = append(deliveries, d)
+	})
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if body := <-received; body != `{"status":"done"}` {
+		t.Fatalf("Unexpected body %s", body)
+	}
+	if len(deliveries) != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", len(deliveries))
+	}
+	for i, d := range deliveries {
+		if d.Attempt != i+1 {
+			t.Fatalf("Expected attempt %d, got %d", i+1, d.Attempt)
+		}
+	}
+	if deliveries[0].StatusCode != http.StatusServiceUnavailable || deliveries[0].Err == nil {
+		t.Fatalf("Expected first attempt to fail with 503, got %+v", deliveries[0])
+	}
+	if deliveries[2].StatusCode != http.StatusOK || deliveries[2].Err != nil {
+		t.Fatalf("Expected last attempt to succeed, got %+v", deliveries[2])
+	}
+}
+
+func TestSendGivesUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		attempts int
+	}{
+		{name: "client error is final", status: http.StatusBadRequest, attempts: 1},
+		{name: "server error is retried", status: http.StatusInternalServerError, attempts: 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			sender := webhook.NewSender("secret")
+			sender.BaseDelay = time.Millisecond
+			sender.MaxAttempts = 3
+			sender.AllowPrivate = true
+
+			if err := sender.Send(context.Background(), server.URL, "x", nil); err == nil {
+				t.Fatal("Expected an error")
+			}
+			if int(calls.Load()) != tc.attempts {
+				t.Fatalf("Expected %d attempts, got %d", tc.attempts, calls.Load())
+			}
+		})
+	}
+}
+
+func TestSendRefusesPrivateAddresses(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer server.Close()
+
+	sender := webhook.NewSender("secret")
+	sender.BaseDelay = time.Millisecond
+
+	var deliveries []webhook.Delivery
+	err := sender.Send(context.Background(), server.URL, "x", func(d webhook.Delivery) {
+		deliveries = append(deliveries, d)
+	})
+	if !errors.Is(err, webhook.ErrForbiddenAddress) {
+		t.Fatalf("Expected ErrForbiddenAddress, got %v", err)
+	}
+	if len(deliveries) != 1 || calls.Load() != 0 {
+		t.Fatalf("Expected one refused attempt, got %d attempts and %d calls", len(deliveries), calls.Load())
+	}
+	if err := sender.CheckHost(context.Background(), "localhost"); !errors.Is(err, webhook.ErrForbiddenAddress) {
+		t.Fatalf("Expected ErrForbiddenAddress for localhost, got %v", err)
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+	for _, tc := range tests {
+		if got := webhook.PublicAddr(netip.MustParseAddr(tc.addr)); got != tc.public {
+			t.Fatalf("PublicAddr(%s) = %v, expected %v", tc.addr, got, tc.public)
+		}
+	}
+}
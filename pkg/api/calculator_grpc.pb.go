@@ -21,6 +21,8 @@ const _ = grpc.SupportPackageIsVersion9
 const (
 	CalculatorService_Calculate_FullMethodName          = "/calculator.CalculatorService/Calculate"
 	CalculatorService_ValidateExpression_FullMethodName = "/calculator.CalculatorService/ValidateExpression"
+	CalculatorService_Compute_FullMethodName            = "/calculator.CalculatorService/Compute"
+	CalculatorService_CalculateBatch_FullMethodName     = "/calculator.CalculatorService/CalculateBatch"
 )
 
 // CalculatorServiceClient is the client API for CalculatorService service.
@@ -29,6 +31,11 @@ const (
 type CalculatorServiceClient interface {
 	Calculate(ctx context.Context, in *CalculateRequest, opts ...grpc.CallOption) (*CalculateResponse, error)
 	ValidateExpression(ctx context.Context, in *ValidateRequest, opts ...grpc.CallOption) (*ValidateResponse, error)
+	// Compute runs a single operation of a decomposed expression.
+	Compute(ctx context.Context, in *ComputeRequest, opts ...grpc.CallOption) (*ComputeResponse, error)
+	// CalculateBatch evaluates many expressions; responses are in the order
+	// of the requests.
+	CalculateBatch(ctx context.Context, in *CalculateBatchRequest, opts ...grpc.CallOption) (*CalculateBatchResponse, error)
 }
 
 type calculatorServiceClient struct {
@@ -59,12 +66,37 @@ func (c *calculatorServiceClient) ValidateExpression(ctx context.Context, in *Va
 	return out, nil
 }
 
+func (c *calculatorServiceClient) Compute(ctx context.Context, in *ComputeRequest, opts ...grpc.CallOption) (*ComputeResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ComputeResponse)
+	err := c.cc.Invoke(ctx, CalculatorService_Compute_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *calculatorServiceClient) CalculateBatch(ctx context.Context, in *CalculateBatchRequest, opts ...grpc.CallOption) (*CalculateBatchResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CalculateBatchResponse)
+	err := c.cc.Invoke(ctx, CalculatorService_CalculateBatch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // CalculatorServiceServer is the server API for CalculatorService service.
 // All implementations must embed UnimplementedCalculatorServiceServer
 // for forward compatibility.
 type CalculatorServiceServer interface {
 	Calculate(context.Context, *CalculateRequest) (*CalculateResponse, error)
 	ValidateExpression(context.Context, *ValidateRequest) (*ValidateResponse, error)
+	// Compute runs a single operation of a decomposed expression.
+	Compute(context.Context, *ComputeRequest) (*ComputeResponse, error)
+	// CalculateBatch evaluates many expressions; responses are in the order
+	// of the requests.
+	CalculateBatch(context.Context, *CalculateBatchRequest) (*CalculateBatchResponse, error)
 	mustEmbedUnimplementedCalculatorServiceServer()
 }
 
@@ -81,6 +113,12 @@ func (UnimplementedCalculatorServiceServer) Calculate(context.Context, *Calculat
 func (UnimplementedCalculatorServiceServer) ValidateExpression(context.Context, *ValidateRequest) (*ValidateResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ValidateExpression not implemented")
 }
+func (UnimplementedCalculatorServiceServer) Compute(context.Context, *ComputeRequest) (*ComputeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Compute not implemented")
+}
+func (UnimplementedCalculatorServiceServer) CalculateBatch(context.Context, *CalculateBatchRequest) (*CalculateBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CalculateBatch not implemented")
+}
 func (UnimplementedCalculatorServiceServer) mustEmbedUnimplementedCalculatorServiceServer() {}
 func (UnimplementedCalculatorServiceServer) testEmbeddedByValue()                           {}
 
@@ -138,6 +176,42 @@ func _CalculatorService_ValidateExpression_Handler(srv interface{}, ctx context.
 	return interceptor(ctx, in, info, handler)
 }
 
+func _CalculatorService_Compute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ComputeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculatorServiceServer).Compute(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CalculatorService_Compute_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculatorServiceServer).Compute(ctx, req.(*ComputeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CalculatorService_CalculateBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CalculateBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CalculatorServiceServer).CalculateBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CalculatorService_CalculateBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CalculatorServiceServer).CalculateBatch(ctx, req.(*CalculateBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // CalculatorService_ServiceDesc is the grpc.ServiceDesc for CalculatorService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -153,6 +227,14 @@ var CalculatorService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ValidateExpression",
 			Handler:    _CalculatorService_ValidateExpression_Handler,
 		},
+		{
+			MethodName: "Compute",
+			Handler:    _CalculatorService_Compute_Handler,
+		},
+		{
+			MethodName: "CalculateBatch",
+			Handler:    _CalculatorService_CalculateBatch_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "calculator.proto",
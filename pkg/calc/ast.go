@@ -0,0 +1,61 @@
+package calc
+
+// Node is an element of a parsed expression. Pos reports the byte offset of
+// the first character belonging to the node.
+type Node interface {
+	Pos() int
+}
+
+type NumberLit struct {
+	Value  float64
+	Raw    string
+	Offset int
+}
+
+type UnaryExpr struct {
+	Op    TokenKind
+	X     Node
+	OpPos int
+}
+
+type BinaryExpr struct {
+	Op    TokenKind
+	X     Node
+	Y     Node
+	OpPos int
+}
+
+type ParenExpr struct {
+	X      Node
+	Lparen int
+}
+
+// CallExpr is a function call such as max(1, 2). Functions are resolved
+// against the registry at validation and evaluation time, not while parsing.
+type CallExpr struct {
+	Name    string
+	NamePos int
+	Args    []Node
+}
+
+// Ident is a reference to a built-in constant or a caller-supplied variable.
+type Ident struct {
+	Name    string
+	NamePos int
+}
+
+// AssignExpr binds Name to the value of Value. It is only valid as the whole
+// expression, e.g. "r = 3".
+type AssignExpr struct {
+	Name    string
+	NamePos int
+	Value   Node
+}
+
+func (n *NumberLit) Pos() int  { return n.Offset }
+func (n *Ident) Pos() int      { return n.NamePos }
+func (n *AssignExpr) Pos() int { return n.NamePos }
+func (n *CallExpr) Pos() int   { return n.NamePos }
+func (n *UnaryExpr) Pos() int  { return n.OpPos }
+func (n *BinaryExpr) Pos() int { return n.X.Pos() }
+func (n *ParenExpr) Pos() int  { return n.Lparen }
@@ -1,41 +1,63 @@
 package calc
 
 import (
-	"go/ast"
-	"go/parser"
-	"go/token"
+	"context"
 	"log"
-	"os"
-	"path/filepath"
-	"runtime"
-	"strconv"
-	"strings"
 	"sync"
-	"time"
-
-	"github.com/joho/godotenv"
+	"sync/atomic"
 )
 
 type Result struct {
+	JobID      int64
 	Expression string
 	Value      float64
 	Err        error
 }
 
+// Job is a handle to an expression submitted to a WorkerPool. Its result
+// is available once Done is closed.
+type Job struct {
+	ID         int64
+	Expression string
+
+	ctx    context.Context
+	done   chan struct{}
+	result Result
+}
+
+// Done is closed when the job's result is ready.
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Wait blocks until the job is finished or ctx is done.
+func (j *Job) Wait(ctx context.Context) (Result, error) {
+	select {
+	case <-j.done:
+		return j.result, nil
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	}
+}
+
+// WorkerPool evaluates submitted expressions with a fixed number of
+// workers. Each submission gets its own Job, so equal expressions and
+// results arriving out of order never get mixed up.
 type WorkerPool struct {
-	jobs     chan string
-	results  chan Result
-	workers  int
-	stopChan chan struct{}
-	wg       sync.WaitGroup
+	jobs    chan *Job
+	workers int
+	wg      sync.WaitGroup
+	nextID  atomic.Int64
+
+	// mu guards closed and the send on jobs, so Close never races a Submit
+	mu     sync.RWMutex
+	closed bool
 }
 
 func NewWorkerPool(numWorkers int) *WorkerPool {
 	return &WorkerPool{
-		jobs:     make(chan string, numWorkers),
-		results:  make(chan Result, numWorkers),
-		workers:  numWorkers,
-		stopChan: make(chan struct{}),
+		jobs:    make(chan *Job, numWorkers),
+		workers: numWorkers,
 	}
 }
 
@@ -50,126 +72,160 @@ func (wp *WorkerPool) Start() {
 func (wp *WorkerPool) worker() {
 	defer wp.wg.Done()
 	log.Println("Worker: started")
-	for {
-		select {
-		case job, ok := <-wp.jobs:
-			if !ok {
-				log.Println("Worker: jobs channel closed, exiting")
-				return
-			}
-			log.Printf("Worker: received job: %s", job)
-			value, err := Calc(job)
-			log.Printf("Worker: calculated result for job %s: %v, error: %v", job, value, err)
-			wp.results <- Result{
-				Expression: job,
-				Value:      value,
-				Err:        err,
-			}
-			log.Printf("Worker: result sent for job %s", job)
-		case <-wp.stopChan:
-			log.Println("Worker: stop signal received, exiting")
-			return
+	for job := range wp.jobs {
+		log.Printf("Worker: received job %d: %s", job.ID, job.Expression)
+		value, err := CalcContext(job.ctx, job.Expression)
+		log.Printf("Worker: calculated result for job %d: %v, error: %v", job.ID, value, err)
+		job.result = Result{
+			JobID:      job.ID,
+			Expression: job.Expression,
+			Value:      value,
+			Err:        err,
 		}
+		close(job.done)
 	}
+	log.Println("Worker: jobs channel closed, exiting")
 }
 
-func (wp *WorkerPool) Submit(expression string) {
-	log.Printf("WorkerPool: submitting expression: %s", expression)
-	wp.jobs <- expression
-	log.Printf("WorkerPool: expression submitted: %s", expression)
-}
+// Submit queues expression for evaluation. ctx bounds both the wait for a
+// free slot in the queue and the evaluation itself. After Close it returns
+// ErrPoolClosed.
+func (wp *WorkerPool) Submit(ctx context.Context, expression string) (*Job, error) {
+	job := &Job{
+		ID:         wp.nextID.Add(1),
+		Expression: expression,
+		ctx:        ctx,
+		done:       make(chan struct{}),
+	}
+
+	wp.mu.RLock()
+	defer wp.mu.RUnlock()
+	if wp.closed {
+		return nil, ErrPoolClosed
+	}
 
-func (wp *WorkerPool) GetResult() Result {
-	log.Println("WorkerPool: waiting for result")
-	result := <-wp.results
-	log.Printf("WorkerPool: received result: %v, error: %v", result.Value, result.Err)
-	return result
+	log.Printf("WorkerPool: submitting job %d: %s", job.ID, expression)
+	select {
+	case wp.jobs <- job:
+		return job, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
+
+// Close stops accepting jobs, lets the workers finish the queued ones and
+// waits for them. It is safe to call more than once.
 func (wp *WorkerPool) Close() {
+	wp.mu.Lock()
+	if wp.closed {
+		wp.mu.Unlock()
+		return
+	}
+	wp.closed = true
 	close(wp.jobs)
-	close(wp.stopChan)
+	wp.mu.Unlock()
 	wp.wg.Wait()
-	close(wp.results)
 }
 
-func Calc(expression string) (float64, error) {
-	log.Printf("Calc: parsing expression: %s", expression)
-	node, err := parser.ParseExpr(expression)
-	if expression == "" {
-		log.Println("Calc: empty expression")
-		return 0, ErrEOF
-	}
-	if err != nil {
-		log.Printf("Calc: parsing error: %v", err)
-		return 0, ErrInvalidExpression
-	}
-	return evalNode(node)
-}
 func (wp *WorkerPool) ValidateExpression(expression string) error {
-	if strings.TrimSpace(expression) == "" {
-		return ErrEOF
-	}
+	return Validate(expression, nil)
+}
 
-	expr, err := parser.ParseExpr(expression)
+// Validate reports whether expression can be evaluated with env without
+// running it: syntax, names, arity and errors visible in constant operands.
+// Like NewPlan it rejects assignments: only a console session keeps
+// variables between expressions.
+func Validate(expression string, env map[string]float64) error {
+	node, err := Parse(expression)
 	if err != nil {
-		return ErrInvalidExpression
+		return err
 	}
 
-	return validateNode(expr)
+	return validateNode(node, env)
 }
 
-func validateNode(node ast.Node) error {
+func validateNode(node Node, env map[string]float64) error {
 	switch n := node.(type) {
-	case *ast.BinaryExpr:
-		err := validateNode(n.X)
+	case *BinaryExpr:
+		err := validateNode(n.X, env)
 		if err != nil {
 			return err
 		}
 
-		err = validateNode(n.Y)
+		err = validateNode(n.Y, env)
 		if err != nil {
 			return err
 		}
 
-		if n.Op == token.QUO {
-			if right, ok := n.Y.(*ast.BasicLit); ok {
-				if right.Kind == token.INT || right.Kind == token.FLOAT {
-					value, err := strconv.ParseFloat(right.Value, 64)
-					if err == nil && value == 0 {
-						return ErrDivisionByZero
-					}
-				}
+		if right, ok := constantValue(n.Y); ok && right == 0 {
+			switch n.Op {
+			case TokenSlash:
+				return ErrDivisionByZero
+			case TokenPercent:
+				return ErrModuloByZero
+			case TokenDoubleSlash:
+				return ErrIntDivisionByZero
 			}
 		}
 
 		switch n.Op {
-		case token.ADD, token.SUB, token.MUL, token.QUO:
+		case TokenPlus, TokenMinus, TokenStar, TokenSlash, TokenPower, TokenPercent, TokenDoubleSlash:
 			return nil
 		default:
 			return ErrInvalidExpression
 		}
 
-	case *ast.BasicLit:
-		if n.Kind != token.FLOAT && n.Kind != token.INT {
-			return ErrInvalidExpression
+	case *NumberLit:
+		return nil
+
+	case *Ident:
+		_, err := lookupName(n.Name, env)
+		return err
+
+	case *AssignExpr:
+		if err := checkAssignable(n.Name, nil); err != nil {
+			return err
 		}
+		return validateNode(n.Value, env)
 
-		_, err := strconv.ParseFloat(n.Value, 64)
-		if err != nil {
-			return ErrInvalidExpression
+	case *CallExpr:
+		fn, ok := LookupFunction(n.Name)
+		if !ok {
+			return &FunctionError{Func: n.Name, Err: ErrUnknownFunction}
+		}
+		if err := fn.checkArity(len(n.Args)); err != nil {
+			return err
+		}
+
+		args := make([]float64, 0, len(n.Args))
+		for _, arg := range n.Args {
+			if err := validateNode(arg, env); err != nil {
+				return err
+			}
+			if value, ok := constantValue(arg); ok {
+				args = append(args, value)
+			}
+		}
+		// Как и с делением на ноль: если все аргументы известны заранее,
+		// ошибку области определения можно поймать еще до вычисления
+		if len(args) == len(n.Args) {
+			if _, err := fn.apply(args); err != nil {
+				return err
+			}
 		}
+		return nil
 
-	case *ast.ParenExpr:
-		return validateNode(n.X)
+	case *ParenExpr:
+		return validateNode(n.X, env)
 
-	case *ast.UnaryExpr:
-		err := validateNode(n.X)
+	case *UnaryExpr:
+		err := validateNode(n.X, env)
 		if err != nil {
 			return err
 		}
 
 		switch n.Op {
-		case token.SUB, token.ADD:
+		case TokenMinus, TokenPlus:
 			return nil
 		default:
 			return ErrInvalidExpression
@@ -178,111 +234,26 @@ func validateNode(node ast.Node) error {
 	default:
 		return ErrInvalidExpression
 	}
-
-	return nil
 }
 
-func evalNode(node ast.Node) (float64, error) {
-	// Формируем абсолютный путь к .env
-	_, filename, _, _ := runtime.Caller(0)
-	dir := filepath.Dir(filename)
-	envPath := filepath.Join(dir, "../../.env")
-
-	err := godotenv.Load(envPath)
-	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
-	}
+// constantValue folds literals, signs and parentheses; anything else is not
+// known before evaluation.
+func constantValue(node Node) (float64, bool) {
 	switch n := node.(type) {
-	case *ast.BinaryExpr:
-		log.Printf("evalNode: evaluating binary expression: %v", n)
-		left, err := evalNode(n.X)
-		if err != nil {
-			log.Printf("evalNode: error evaluating left operand: %v", err)
-			return 0, ErrInvalidExpression
-		}
-		right, err := evalNode(n.Y)
-		if err != nil {
-			log.Printf("evalNode: error evaluating right operand: %v", err)
-			return 0, ErrInvalidExpression
+	case *NumberLit:
+		return n.Value, true
+	case *ParenExpr:
+		return constantValue(n.X)
+	case *UnaryExpr:
+		value, ok := constantValue(n.X)
+		if !ok {
+			return 0, false
 		}
-
-		switch n.Op {
-		case token.ADD:
-			ta, _ := strconv.Atoi(os.Getenv("TIME_ADDITION_MS"))
-			sleepTime := time.Millisecond * time.Duration(ta)
-			log.Printf("evalNode: sleeping for addition: %v", sleepTime)
-			time.Sleep(sleepTime)
-			log.Printf("evalNode: addition result: %f", left+right)
-			return left + right, nil
-		case token.SUB:
-			ts, _ := strconv.Atoi(os.Getenv("TIME_SUBTRACTION_MS"))
-			sleepTime := time.Millisecond * time.Duration(ts)
-			log.Printf("evalNode: sleeping for subtraction: %v", sleepTime)
-			time.Sleep(sleepTime)
-			log.Printf("evalNode: subtraction result: %f", left-right)
-			return left - right, nil
-		case token.MUL:
-			tm, _ := strconv.Atoi(os.Getenv("TIME_MULTIPLICATIONS_MS"))
-			sleepTime := time.Millisecond * time.Duration(tm)
-			log.Printf("evalNode: sleeping for multiplication: %v", sleepTime)
-			time.Sleep(sleepTime)
-			log.Printf("evalNode: multiplication result: %f", left*right)
-			return left * right, nil
-		case token.QUO:
-			if right == 0 {
-				log.Println("evalNode: division by zero")
-				return 0, ErrDivisionByZero
-			}
-			td, _ := strconv.Atoi(os.Getenv("TIME_DIVISIONS_MS"))
-			sleepTime := time.Millisecond * time.Duration(td)
-			log.Printf("evalNode: sleeping for division: %v", sleepTime)
-			time.Sleep(sleepTime)
-			log.Printf("evalNode: division result: %f", left/right)
-			return left / right, nil
-		default:
-			log.Printf("evalNode: unsupported binary operator: %v", n.Op)
-			return 0, ErrInvalidExpression
-		}
-
-	case *ast.BasicLit:
-		log.Printf("evalNode: evaluating literal: %v", n)
-		if n.Kind != token.FLOAT && n.Kind != token.INT {
-			log.Printf("evalNode: unsupported literal type: %v", n.Kind)
-			return 0, ErrInvalidExpression
-		}
-		value, err := strconv.ParseFloat(n.Value, 64)
-		if err != nil {
-			log.Printf("evalNode: error parsing literal: %v", err)
-			return 0, ErrInvalidExpression
+		if n.Op == TokenMinus {
+			return -value, true
 		}
-		log.Printf("evalNode: parsed literal: %f", value)
-		return value, nil
-
-	case *ast.ParenExpr:
-		log.Println("evalNode: evaluating parenthesized expression")
-		return evalNode(n.X)
-
-	case *ast.UnaryExpr:
-		log.Println("evalNode: evaluating unary expression")
-		value, err := evalNode(n.X)
-		if err != nil {
-			log.Printf("evalNode: error evaluating unary operand: %v", err)
-			return 0, ErrInvalidExpression
-		}
-		switch n.Op {
-		case token.SUB:
-			log.Printf("evalNode: unary negation result: %f", -value)
-			return -value, nil
-		case token.ADD:
-			log.Printf("evalNode: unary plus result: %f", value)
-			return value, nil
-		default:
-			log.Printf("evalNode: unsupported unary operator: %v", n.Op)
-			return 0, ErrInvalidExpression
-		}
-
+		return value, true
 	default:
-		log.Printf("evalNode: unsupported node type: %T", node)
-		return 0, ErrInvalidExpression
+		return 0, false
 	}
 }
@@ -1,7 +1,11 @@
 package calc_test
 
 import (
+	"context"
+	"errors"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/shzuzu/Go_Calculator/pkg/calc"
 )
@@ -37,6 +41,56 @@ func TestCals(t *testing.T) {
 			expression:     "1 / -(2 + 3)",
 			expectedResult: -0.2,
 		},
+		{
+			name:           "implicit multiplication",
+			expression:     "3(4)",
+			expectedResult: 12,
+		},
+		{
+			name:           "power",
+			expression:     "2^3 + 2**2",
+			expectedResult: 12,
+		},
+		{
+			name:           "power is right-associative",
+			expression:     "2^3^2",
+			expectedResult: 512,
+		},
+		{
+			name:           "power binds tighter than unary minus",
+			expression:     "-2^2 + 2^-1",
+			expectedResult: -3.5,
+		},
+		{
+			name:           "modulo",
+			expression:     "7 % 4 * 2",
+			expectedResult: 6,
+		},
+		{
+			name:           "integer division",
+			expression:     "7 // 2 + -7 // 2",
+			expectedResult: -1,
+		},
+		{
+			name:           "functions",
+			expression:     "sqrt(16) + abs(-2) * max(1, 3, 2)",
+			expectedResult: 10,
+		},
+		{
+			name:           "variadic and nested calls",
+			expression:     "sum(1, 2, min(3, 4)) + round(2.567, 2)",
+			expectedResult: 8.57,
+		},
+		{
+			name:           "log with base",
+			expression:     "log(8, 2)",
+			expectedResult: 3,
+		},
+		{
+			name:           "exponent literal",
+			expression:     "1.5e2 + .5",
+			expectedResult: 150.5,
+		},
 	}
 	for _, tc := range testSucces {
 		t.Run(tc.name, func(t *testing.T) {
@@ -60,7 +114,7 @@ func TestCals(t *testing.T) {
 		},
 		{
 			name:       "priority",
-			expression: "2+2**2",
+			expression: "2+2***2",
 		},
 		{
 			name:       "priority",
@@ -70,6 +124,40 @@ func TestCals(t *testing.T) {
 			name:       "/",
 			expression: "",
 		},
+		{
+			name:       "unclosed paren",
+			expression: "(1+2",
+		},
+		{
+			name:       "unknown character",
+			expression: "2 & 3",
+		},
+		{
+			name:       "go syntax",
+			expression: "1 << 2",
+		},
+	}
+	testOperatorErrors := []struct {
+		expression  string
+		expectedErr error
+	}{
+		{expression: "5 % (1-1)", expectedErr: calc.ErrModuloByZero},
+		{expression: "5 // (2-2)", expectedErr: calc.ErrIntDivisionByZero},
+		{expression: "(0-8) ^ 0.5", expectedErr: calc.ErrInvalidPower},
+		{expression: "0 ^ -1", expectedErr: calc.ErrInvalidPower},
+		{expression: "sqrt(-1)", expectedErr: calc.ErrDomain},
+		{expression: "log(0)", expectedErr: calc.ErrDomain},
+		{expression: "sqrt(1, 2)", expectedErr: calc.ErrArgumentCount},
+		{expression: "max()", expectedErr: calc.ErrArgumentCount},
+		{expression: "foo(1)", expectedErr: calc.ErrUnknownFunction},
+	}
+	for _, tc := range testOperatorErrors {
+		t.Run(tc.expression, func(t *testing.T) {
+			_, err := calc.Calc(tc.expression)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+		})
 	}
 	for _, tc := range testFail {
 		t.Run(tc.name, func(t *testing.T) {
@@ -80,3 +168,257 @@ func TestCals(t *testing.T) {
 		})
 	}
 }
+
+func TestSyntaxError(t *testing.T) {
+	tests := []struct {
+		expression string
+		offset     int
+		token      string
+		caret      string
+	}{
+		{expression: "2 + * 3", offset: 4, token: "*", caret: "2 + * 3\n    ^"},
+		{expression: "(1+2", offset: 4, token: "", caret: "(1+2\n    ^"},
+		{expression: "1 $ 2", offset: 2, token: "$", caret: "1 $ 2\n  ^"},
+		{expression: "1 2", offset: 2, token: "2", caret: "1 2\n  ^"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.expression, func(t *testing.T) {
+			_, err := calc.Calc(tc.expression)
+			var syntaxErr *calc.SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("expected *calc.SyntaxError, got %v", err)
+			}
+			if !errors.Is(err, calc.ErrInvalidExpression) {
+				t.Fatalf("syntax error should match ErrInvalidExpression")
+			}
+			if syntaxErr.Offset != tc.offset {
+				t.Fatalf("Expected offset %d, got %d", tc.offset, syntaxErr.Offset)
+			}
+			if syntaxErr.Token != tc.token {
+				t.Fatalf("Expected token %q, got %q", tc.token, syntaxErr.Token)
+			}
+			if syntaxErr.Expected == "" {
+				t.Fatal("Expected hint should not be empty")
+			}
+			if caret := syntaxErr.Caret(); caret != tc.caret {
+				t.Fatalf("Expected caret\n%s\ngot\n%s", tc.caret, caret)
+			}
+		})
+	}
+}
+
+func TestValidateFunctions(t *testing.T) {
+	wp := calc.NewWorkerPool(1)
+	tests := []struct {
+		expression  string
+		expectedErr error
+	}{
+		{expression: "sqrt(2) + min(1, 2, 3)", expectedErr: nil},
+		{expression: "sqrt(-(4))", expectedErr: calc.ErrDomain},
+		{expression: "sqrt(2 - 4)", expectedErr: nil},
+		{expression: "atan2(1)", expectedErr: calc.ErrArgumentCount},
+		{expression: "nope(1)", expectedErr: calc.ErrUnknownFunction},
+		{expression: "sqrt 2", expectedErr: calc.ErrInvalidExpression},
+	}
+	for _, tc := range tests {
+		t.Run(tc.expression, func(t *testing.T) {
+			err := wp.ValidateExpression(tc.expression)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	wp := calc.NewWorkerPool(2)
+	wp.Start()
+
+	expressions := []string{"2+2", "2+2", "3*3", "1/0"}
+	expected := []float64{4, 4, 9, 0}
+	jobs := make([]*calc.Job, len(expressions))
+	for i, expr := range expressions {
+		job, err := wp.Submit(context.Background(), expr)
+		if err != nil {
+			t.Fatalf("Failed to submit %q: %v", expr, err)
+		}
+		jobs[i] = job
+	}
+
+	seen := make(map[int64]bool)
+	for i, job := range jobs {
+		if seen[job.ID] {
+			t.Fatalf("Duplicate job ID %d", job.ID)
+		}
+		seen[job.ID] = true
+
+		result, err := job.Wait(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to wait for job %d: %v", job.ID, err)
+		}
+		if result.JobID != job.ID || result.Expression != expressions[i] {
+			t.Fatalf("Job %d got result of another job: %+v", job.ID, result)
+		}
+		if result.Value != expected[i] {
+			t.Fatalf("Expected %v for %q, got %v", expected[i], expressions[i], result.Value)
+		}
+	}
+	if result, _ := jobs[3].Wait(context.Background()); !errors.Is(result.Err, calc.ErrDivisionByZero) {
+		t.Fatalf("Expected %v, got %v", calc.ErrDivisionByZero, result.Err)
+	}
+
+	wp.Close()
+	wp.Close()
+	if _, err := wp.Submit(context.Background(), "1+1"); !errors.Is(err, calc.ErrPoolClosed) {
+		t.Fatalf("Expected %v after Close, got %v", calc.ErrPoolClosed, err)
+	}
+}
+
+func TestEvalWithEnv(t *testing.T) {
+	env := map[string]float64{"r": 2}
+
+	value, err := calc.EvalWithEnv("pi * r^2", env)
+	if err != nil {
+		t.Fatalf("Failed to evaluate with env: %v", err)
+	}
+	if value != math.Pi*4 {
+		t.Fatalf("Expected %f, got %f", math.Pi*4, value)
+	}
+
+	value, err = calc.EvalWithEnv("h = r * 3", env)
+	if err != nil {
+		t.Fatalf("Failed to assign: %v", err)
+	}
+	if value != 6 || env["h"] != 6 {
+		t.Fatalf("Expected h = 6, got %f (env %v)", value, env)
+	}
+
+	value, err = calc.EvalWithEnv("h + tau / pi + e - e", env)
+	if err != nil {
+		t.Fatalf("Failed to use assigned variable: %v", err)
+	}
+	if value != 8 {
+		t.Fatalf("Expected 8, got %f", value)
+	}
+
+	tests := []struct {
+		expression  string
+		env         map[string]float64
+		expectedErr error
+	}{
+		{expression: "x + 1", env: env, expectedErr: calc.ErrUndefinedVariable},
+		{expression: "pi = 3", env: env, expectedErr: calc.ErrConstantAssignment},
+		{expression: "r = 3", env: nil, expectedErr: calc.ErrAssignmentNotAllowed},
+		{expression: "1 + r = 3", env: env, expectedErr: calc.ErrInvalidExpression},
+	}
+	for _, tc := range tests {
+		t.Run(tc.expression, func(t *testing.T) {
+			_, err := calc.EvalWithEnv(tc.expression, tc.env)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+			if err := calc.Validate(tc.expression, tc.env); !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("Validate: expected error %v, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+
+	// выражение с переменными все равно не может ничего присвоить: NewPlan
+	// отклонит его при вычислении
+	if err := calc.Validate("r = 3", env); !errors.Is(err, calc.ErrAssignmentNotAllowed) {
+		t.Fatalf("Expected ErrAssignmentNotAllowed, got %v", err)
+	}
+}
+
+func TestCalcContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := calc.CalcContext(ctx, "1+1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	evaluator := calc.NewEvaluator(calc.Config{AdditionDelay: 10 * time.Second})
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := evaluator.CalcContext(ctx, "1+1+1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Evaluation should stop at the deadline, took %v", elapsed)
+	}
+}
+
+func TestEvaluatorDelays(t *testing.T) {
+	evaluator := calc.NewEvaluator(calc.Config{MultiplicationDelay: 30 * time.Millisecond})
+
+	start := time.Now()
+	value, err := evaluator.Calc("2*3+1")
+	if err != nil {
+		t.Fatalf("Failed to calculate: %v", err)
+	}
+	if value != 7 {
+		t.Fatalf("Expected 7, got %f", value)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("Expected multiplication delay to be applied, took %v", elapsed)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	plan, err := calc.NewPlan("(a+b)*(c+d) - -sqrt(4)", map[string]float64{"a": 1, "b": 2, "c": 3, "d": 4})
+	if err != nil {
+		t.Fatalf("Failed to build plan: %v", err)
+	}
+	// a+b, c+d, *, sqrt, neg, -
+	if len(plan.Steps) != 6 {
+		t.Fatalf("Expected 6 steps, got %d: %+v", len(plan.Steps), plan.Steps)
+	}
+	if deps := plan.Steps[0].Deps(); len(deps) != 0 {
+		t.Fatalf("First addition should not depend on anything, got %v", deps)
+	}
+	if deps := plan.Steps[1].Deps(); len(deps) != 0 {
+		t.Fatalf("Second addition should not depend on anything, got %v", deps)
+	}
+	if deps := plan.Steps[2].Deps(); len(deps) != 2 || deps[0] != 0 || deps[1] != 1 {
+		t.Fatalf("Multiplication should depend on both additions, got %v", deps)
+	}
+
+	values := make([]float64, len(plan.Steps))
+	for i, step := range plan.Steps {
+		args := make([]float64, len(step.Args))
+		for j, arg := range step.Args {
+			if arg.Step >= 0 {
+				args[j] = values[arg.Step]
+			} else {
+				args[j] = arg.Value
+			}
+		}
+		values[i], err = calc.Apply(context.Background(), step.Op, args)
+		if err != nil {
+			t.Fatalf("Failed to apply %s: %v", step.Op, err)
+		}
+	}
+	if root := values[len(values)-1]; root != 23 {
+		t.Fatalf("Expected 23, got %f", root)
+	}
+
+	plan, err = calc.NewPlan("-(pi - pi) + -2", nil)
+	if err != nil {
+		t.Fatalf("Failed to build plan: %v", err)
+	}
+	// pi-pi, neg, +; "-2" is folded into a constant
+	if len(plan.Steps) != 3 || plan.Steps[1].Op != calc.OpNegate {
+		t.Fatalf("Expected 3 steps with negation, got %+v", plan.Steps)
+	}
+
+	plan, err = calc.NewPlan("-(5)", nil)
+	if err != nil || len(plan.Steps) != 0 || plan.Value != -5 {
+		t.Fatalf("Expected constant -5 plan, got %+v, %v", plan, err)
+	}
+
+	if _, err := calc.NewPlan("x = 1", map[string]float64{}); !errors.Is(err, calc.ErrAssignmentNotAllowed) {
+		t.Fatalf("Expected ErrAssignmentNotAllowed, got %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package calc
+
+import (
+	"math"
+	"sort"
+)
+
+// constants are always in scope and cannot be reassigned or shadowed by
+// caller-supplied variables.
+var constants = map[string]float64{
+	"pi":  math.Pi,
+	"e":   math.E,
+	"tau": 2 * math.Pi,
+}
+
+// Constants returns the names of the built-in constants in sorted order.
+func Constants() []string {
+	names := make([]string, 0, len(constants))
+	for name := range constants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupName resolves an identifier: built-in constants first, then env.
+func lookupName(name string, env map[string]float64) (float64, error) {
+	if value, ok := constants[name]; ok {
+		return value, nil
+	}
+	if value, ok := env[name]; ok {
+		return value, nil
+	}
+	return 0, &NameError{Name: name, Err: ErrUndefinedVariable}
+}
+
+func checkAssignable(name string, env map[string]float64) error {
+	if _, ok := constants[name]; ok {
+		return &NameError{Name: name, Err: ErrConstantAssignment}
+	}
+	if env == nil {
+		return &NameError{Name: name, Err: ErrAssignmentNotAllowed}
+	}
+	return nil
+}
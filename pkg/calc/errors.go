@@ -1,12 +1,108 @@
 package calc
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var (
 	ErrInvalidExpression = errors.New("invalid expression")
 	ErrDivisionByZero    = errors.New("division by zero")
 	ErrEOF               = errors.New("empty expression ")
+	ErrModuloByZero      = errors.New("modulo by zero")
+	ErrIntDivisionByZero = errors.New("integer division by zero")
+	ErrInvalidPower      = errors.New("power is undefined for these operands")
+	ErrUnknownFunction   = errors.New("unknown function")
+	ErrArgumentCount     = errors.New("wrong number of arguments")
+	ErrDomain            = errors.New("argument out of domain")
+
+	ErrUndefinedVariable    = errors.New("undefined variable")
+	ErrConstantAssignment   = errors.New("cannot assign to a constant")
+	ErrAssignmentNotAllowed = errors.New("assignment requires an environment")
+
+	ErrPoolClosed = errors.New("worker pool is closed")
 	// ErrUnsupportedLiteral  = errors.New("unsupported literal type")
 	// ErrUnsupportedOperator = errors.New("unsupported operator")
 	// ErrUnsupportedNode     = errors.New("unsupported node type")
 )
+
+// SyntaxError describes where an expression stopped making sense. Offset is
+// a byte offset into Expression; Token is the offending lexeme (empty at the
+// end of input) and Expected hints at what the parser was looking for.
+// It matches ErrInvalidExpression with errors.Is.
+type SyntaxError struct {
+	Expression string
+	Offset     int
+	Token      string
+	Expected   string
+}
+
+func (e *SyntaxError) Error() string {
+	found := "end of expression"
+	if e.Token != "" {
+		found = fmt.Sprintf("%q", e.Token)
+	}
+	if e.Expected == "" {
+		return fmt.Sprintf("syntax error at position %d: unexpected %s", e.Offset, found)
+	}
+	return fmt.Sprintf("syntax error at position %d: unexpected %s, expected %s", e.Offset, found, e.Expected)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return ErrInvalidExpression
+}
+
+// Caret renders the expression with a caret under the offending position:
+//
+//	2 + * 3
+//	    ^
+func (e *SyntaxError) Caret() string {
+	offset := e.Offset
+	if offset > len(e.Expression) {
+		offset = len(e.Expression)
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	var pad strings.Builder
+	for _, r := range e.Expression[:offset] {
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteByte(' ')
+		}
+	}
+	return e.Expression + "\n" + pad.String() + "^"
+}
+
+// FunctionError reports a failed function call, e.g. sqrt(-1) or max().
+// Err is one of ErrUnknownFunction, ErrArgumentCount or ErrDomain.
+type FunctionError struct {
+	Func string
+	Err  error
+}
+
+func (e *FunctionError) Error() string {
+	return e.Func + ": " + e.Err.Error()
+}
+
+func (e *FunctionError) Unwrap() error {
+	return e.Err
+}
+
+// NameError reports a problem with an identifier: a variable that is not
+// defined or an assignment that is not allowed.
+type NameError struct {
+	Name string
+	Err  error
+}
+
+func (e *NameError) Error() string {
+	return e.Name + ": " + e.Err.Error()
+}
+
+func (e *NameError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,244 @@
+package calc
+
+import (
+	"context"
+	"log"
+	"math"
+	"time"
+)
+
+// Config holds evaluator settings. Delays emulate expensive operations and
+// are applied once per evaluated operator.
+type Config struct {
+	AdditionDelay       time.Duration
+	SubtractionDelay    time.Duration
+	MultiplicationDelay time.Duration
+	DivisionDelay       time.Duration
+	PowerDelay          time.Duration
+	ModuloDelay         time.Duration
+	IntDivisionDelay    time.Duration
+}
+
+// Evaluator evaluates expressions with a fixed Config. It holds no mutable
+// state and is safe for concurrent use.
+type Evaluator struct {
+	config Config
+}
+
+func NewEvaluator(config Config) *Evaluator {
+	return &Evaluator{config: config}
+}
+
+// defaultEvaluator backs the package-level helpers and has no delays.
+var defaultEvaluator = NewEvaluator(Config{})
+
+func Calc(expression string) (float64, error) {
+	return defaultEvaluator.Calc(expression)
+}
+
+// CalcContext is Calc that stops between operations, including while
+// sleeping for the configured operation delays, once ctx is done. In that
+// case it returns ctx.Err().
+func CalcContext(ctx context.Context, expression string) (float64, error) {
+	return defaultEvaluator.CalcContext(ctx, expression)
+}
+
+// EvalWithEnv evaluates expression with identifiers resolved against the
+// built-in constants and env. An assignment such as "r = 3" stores the value
+// in env and returns it; it fails if env is nil.
+func EvalWithEnv(expression string, env map[string]float64) (float64, error) {
+	return defaultEvaluator.EvalWithEnv(expression, env)
+}
+
+// EvalContext is EvalWithEnv with cancellation, see CalcContext.
+func EvalContext(ctx context.Context, expression string, env map[string]float64) (float64, error) {
+	return defaultEvaluator.EvalContext(ctx, expression, env)
+}
+
+func (e *Evaluator) Calc(expression string) (float64, error) {
+	return e.EvalContext(context.Background(), expression, nil)
+}
+
+func (e *Evaluator) CalcContext(ctx context.Context, expression string) (float64, error) {
+	return e.EvalContext(ctx, expression, nil)
+}
+
+func (e *Evaluator) EvalWithEnv(expression string, env map[string]float64) (float64, error) {
+	return e.EvalContext(context.Background(), expression, env)
+}
+
+func (e *Evaluator) EvalContext(ctx context.Context, expression string, env map[string]float64) (float64, error) {
+	log.Printf("Calc: parsing expression: %s", expression)
+	node, err := Parse(expression)
+	if err == ErrEOF {
+		log.Println("Calc: empty expression")
+		return 0, ErrEOF
+	}
+	if err != nil {
+		log.Printf("Calc: parsing error: %v", err)
+		return 0, err
+	}
+
+	if assign, ok := node.(*AssignExpr); ok {
+		if err := checkAssignable(assign.Name, env); err != nil {
+			return 0, err
+		}
+		value, err := e.evalNode(ctx, assign.Value, env)
+		if err != nil {
+			return 0, err
+		}
+		env[assign.Name] = value
+		return value, nil
+	}
+	return e.evalNode(ctx, node, env)
+}
+
+func (e *Evaluator) evalNode(ctx context.Context, node Node, env map[string]float64) (float64, error) {
+	if err := ctx.Err(); err != nil {
+		log.Printf("evalNode: evaluation cancelled: %v", err)
+		return 0, err
+	}
+	switch n := node.(type) {
+	case *BinaryExpr:
+		log.Printf("evalNode: evaluating binary expression: %v at %d", n.Op, n.OpPos)
+		left, err := e.evalNode(ctx, n.X, env)
+		if err != nil {
+			log.Printf("evalNode: error evaluating left operand: %v", err)
+			return 0, err
+		}
+		right, err := e.evalNode(ctx, n.Y, env)
+		if err != nil {
+			log.Printf("evalNode: error evaluating right operand: %v", err)
+			return 0, err
+		}
+		return e.binary(ctx, n.Op, left, right)
+
+	case *NumberLit:
+		log.Printf("evalNode: evaluating literal: %f", n.Value)
+		return n.Value, nil
+
+	case *Ident:
+		value, err := lookupName(n.Name, env)
+		if err != nil {
+			log.Printf("evalNode: %v", err)
+			return 0, err
+		}
+		log.Printf("evalNode: %s = %f", n.Name, value)
+		return value, nil
+
+	case *CallExpr:
+		log.Printf("evalNode: evaluating call: %s", n.Name)
+		fn, ok := LookupFunction(n.Name)
+		if !ok {
+			log.Printf("evalNode: unknown function: %s", n.Name)
+			return 0, &FunctionError{Func: n.Name, Err: ErrUnknownFunction}
+		}
+		args := make([]float64, 0, len(n.Args))
+		for _, arg := range n.Args {
+			value, err := e.evalNode(ctx, arg, env)
+			if err != nil {
+				log.Printf("evalNode: error evaluating argument of %s: %v", n.Name, err)
+				return 0, err
+			}
+			args = append(args, value)
+		}
+		result, err := fn.apply(args)
+		if err != nil {
+			log.Printf("evalNode: call error: %v", err)
+			return 0, err
+		}
+		log.Printf("evalNode: %s result: %f", n.Name, result)
+		return result, nil
+
+	case *ParenExpr:
+		log.Println("evalNode: evaluating parenthesized expression")
+		return e.evalNode(ctx, n.X, env)
+
+	case *UnaryExpr:
+		log.Println("evalNode: evaluating unary expression")
+		value, err := e.evalNode(ctx, n.X, env)
+		if err != nil {
+			log.Printf("evalNode: error evaluating unary operand: %v", err)
+			return 0, err
+		}
+		switch n.Op {
+		case TokenMinus:
+			log.Printf("evalNode: unary negation result: %f", -value)
+			return -value, nil
+		case TokenPlus:
+			log.Printf("evalNode: unary plus result: %f", value)
+			return value, nil
+		default:
+			log.Printf("evalNode: unsupported unary operator: %v", n.Op)
+			return 0, ErrInvalidExpression
+		}
+
+	default:
+		log.Printf("evalNode: unsupported node type: %T", node)
+		return 0, ErrInvalidExpression
+	}
+}
+
+// binary applies a binary operator after waiting for its configured delay.
+func (e *Evaluator) binary(ctx context.Context, op TokenKind, left, right float64) (float64, error) {
+	var result float64
+	var delay time.Duration
+	switch op {
+	case TokenPlus:
+		result, delay = left+right, e.config.AdditionDelay
+	case TokenMinus:
+		result, delay = left-right, e.config.SubtractionDelay
+	case TokenStar:
+		result, delay = left*right, e.config.MultiplicationDelay
+	case TokenSlash:
+		if right == 0 {
+			log.Println("evalNode: division by zero")
+			return 0, ErrDivisionByZero
+		}
+		result, delay = left/right, e.config.DivisionDelay
+	case TokenPower:
+		result, delay = math.Pow(left, right), e.config.PowerDelay
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			log.Printf("evalNode: undefined power %f ^ %f", left, right)
+			return 0, ErrInvalidPower
+		}
+	case TokenPercent:
+		if right == 0 {
+			log.Println("evalNode: modulo by zero")
+			return 0, ErrModuloByZero
+		}
+		result, delay = math.Mod(left, right), e.config.ModuloDelay
+	case TokenDoubleSlash:
+		if right == 0 {
+			log.Println("evalNode: integer division by zero")
+			return 0, ErrIntDivisionByZero
+		}
+		result, delay = math.Floor(left/right), e.config.IntDivisionDelay
+	default:
+		log.Printf("evalNode: unsupported binary operator: %v", op)
+		return 0, ErrInvalidExpression
+	}
+
+	log.Printf("evalNode: sleeping for %v: %v", op, delay)
+	if err := sleep(ctx, delay); err != nil {
+		return 0, err
+	}
+	log.Printf("evalNode: %v result: %f", op, result)
+	return result, nil
+}
+
+// sleep waits for d or until ctx is done, whichever comes first.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		log.Printf("evalNode: evaluation cancelled: %v", ctx.Err())
+		return ctx.Err()
+	}
+}
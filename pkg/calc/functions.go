@@ -0,0 +1,202 @@
+package calc
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// Variadic is used as Function.MaxArgs for functions without an upper bound
+// on the number of arguments.
+const Variadic = -1
+
+// Function is an entry of the function registry. Call receives arguments
+// that already passed the arity check; a NaN or infinite result is reported
+// as ErrDomain.
+type Function struct {
+	Name    string
+	MinArgs int
+	MaxArgs int
+	Call    func(args []float64) (float64, error)
+}
+
+func (f *Function) checkArity(n int) error {
+	if n < f.MinArgs || (f.MaxArgs != Variadic && n > f.MaxArgs) {
+		return &FunctionError{Func: f.Name, Err: ErrArgumentCount}
+	}
+	return nil
+}
+
+// apply checks arity, calls the function and turns non-finite results into
+// domain errors.
+func (f *Function) apply(args []float64) (float64, error) {
+	if err := f.checkArity(len(args)); err != nil {
+		return 0, err
+	}
+	result, err := f.Call(args)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, &FunctionError{Func: f.Name, Err: ErrDomain}
+	}
+	return result, nil
+}
+
+var (
+	functionsMu sync.RWMutex
+	functions   = map[string]*Function{}
+)
+
+// RegisterFunction adds fn to the registry used by validation and
+// evaluation, replacing any function with the same name.
+func RegisterFunction(fn *Function) {
+	functionsMu.Lock()
+	defer functionsMu.Unlock()
+	functions[fn.Name] = fn
+}
+
+func LookupFunction(name string) (*Function, bool) {
+	functionsMu.RLock()
+	defer functionsMu.RUnlock()
+	fn, ok := functions[name]
+	return fn, ok
+}
+
+// Functions returns the registered functions sorted by name.
+func Functions() []*Function {
+	functionsMu.RLock()
+	defer functionsMu.RUnlock()
+	list := make([]*Function, 0, len(functions))
+	for _, fn := range functions {
+		list = append(list, fn)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func unary(name string, f func(float64) float64) *Function {
+	return &Function{
+		Name:    name,
+		MinArgs: 1,
+		MaxArgs: 1,
+		Call: func(args []float64) (float64, error) {
+			return f(args[0]), nil
+		},
+	}
+}
+
+func init() {
+	for _, fn := range []*Function{
+		unary("sin", math.Sin),
+		unary("cos", math.Cos),
+		unary("tan", math.Tan),
+		unary("asin", math.Asin),
+		unary("acos", math.Acos),
+		unary("atan", math.Atan),
+		unary("sqrt", math.Sqrt),
+		unary("cbrt", math.Cbrt),
+		unary("exp", math.Exp),
+		unary("ln", math.Log),
+		unary("log10", math.Log10),
+		unary("log2", math.Log2),
+		unary("abs", math.Abs),
+		unary("floor", math.Floor),
+		unary("ceil", math.Ceil),
+		unary("trunc", math.Trunc),
+		{
+			// log(x) is the natural logarithm, log(x, b) uses base b.
+			Name:    "log",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Call: func(args []float64) (float64, error) {
+				if len(args) == 1 {
+					return math.Log(args[0]), nil
+				}
+				if args[1] <= 0 || args[1] == 1 {
+					return 0, &FunctionError{Func: "log", Err: ErrDomain}
+				}
+				return math.Log(args[0]) / math.Log(args[1]), nil
+			},
+		},
+		{
+			// round(x) rounds half away from zero, round(x, n) keeps n decimals.
+			Name:    "round",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Call: func(args []float64) (float64, error) {
+				if len(args) == 1 {
+					return math.Round(args[0]), nil
+				}
+				scale := math.Pow(10, math.Trunc(args[1]))
+				return math.Round(args[0]*scale) / scale, nil
+			},
+		},
+		{
+			Name:    "atan2",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Call: func(args []float64) (float64, error) {
+				return math.Atan2(args[0], args[1]), nil
+			},
+		},
+		{
+			Name:    "hypot",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Call: func(args []float64) (float64, error) {
+				return math.Hypot(args[0], args[1]), nil
+			},
+		},
+		{
+			Name:    "min",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Call: func(args []float64) (float64, error) {
+				result := args[0]
+				for _, arg := range args[1:] {
+					result = math.Min(result, arg)
+				}
+				return result, nil
+			},
+		},
+		{
+			Name:    "max",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Call: func(args []float64) (float64, error) {
+				result := args[0]
+				for _, arg := range args[1:] {
+					result = math.Max(result, arg)
+				}
+				return result, nil
+			},
+		},
+		{
+			Name:    "sum",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Call: func(args []float64) (float64, error) {
+				var result float64
+				for _, arg := range args {
+					result += arg
+				}
+				return result, nil
+			},
+		},
+		{
+			Name:    "avg",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Call: func(args []float64) (float64, error) {
+				var result float64
+				for _, arg := range args {
+					result += arg
+				}
+				return result / float64(len(args)), nil
+			},
+		},
+	} {
+		RegisterFunction(fn)
+	}
+}
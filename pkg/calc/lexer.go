@@ -0,0 +1,173 @@
+package calc
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+type TokenKind int
+
+const (
+	TokenEOF TokenKind = iota
+	TokenNumber
+	TokenPlus
+	TokenMinus
+	TokenStar
+	TokenSlash
+	TokenLParen
+	TokenRParen
+	TokenPower
+	TokenPercent
+	TokenDoubleSlash
+	TokenIdent
+	TokenComma
+	TokenAssign
+)
+
+var tokenNames = map[TokenKind]string{
+	TokenEOF:         "end of expression",
+	TokenNumber:      "number",
+	TokenPlus:        "'+'",
+	TokenMinus:       "'-'",
+	TokenStar:        "'*'",
+	TokenSlash:       "'/'",
+	TokenLParen:      "'('",
+	TokenRParen:      "')'",
+	TokenPower:       "'^'",
+	TokenPercent:     "'%'",
+	TokenDoubleSlash: "'//'",
+	TokenIdent:       "identifier",
+	TokenComma:       "','",
+	TokenAssign:      "'='",
+}
+
+func (k TokenKind) String() string {
+	if name, ok := tokenNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("token(%d)", int(k))
+}
+
+// Token is a single lexeme of an expression. Pos is the byte offset of the
+// first character of the token in the source string.
+type Token struct {
+	Kind TokenKind
+	Text string
+	Pos  int
+}
+
+var singleCharTokens = map[byte]TokenKind{
+	'+': TokenPlus,
+	'-': TokenMinus,
+	'*': TokenStar,
+	'/': TokenSlash,
+	'(': TokenLParen,
+	')': TokenRParen,
+	'^': TokenPower,
+	'%': TokenPercent,
+	',': TokenComma,
+	'=': TokenAssign,
+}
+
+// twoCharTokens are matched before singleCharTokens, so "**" is a power
+// rather than two multiplications.
+var twoCharTokens = map[string]TokenKind{
+	"**": TokenPower,
+	"//": TokenDoubleSlash,
+}
+
+// Tokenize splits expression into tokens. The returned slice always ends
+// with a TokenEOF token positioned at len(expression).
+func Tokenize(expression string) ([]Token, error) {
+	var tokens []Token
+	i := 0
+	for i < len(expression) {
+		c := expression[i]
+		switch {
+		case isSpace(c):
+			i++
+		case isDigit(c) || c == '.':
+			end := scanNumber(expression, i)
+			if end == i {
+				return nil, &SyntaxError{Expression: expression, Offset: i, Token: ".", Expected: "number"}
+			}
+			tokens = append(tokens, Token{Kind: TokenNumber, Text: expression[i:end], Pos: i})
+			i = end
+		case isIdentStart(c):
+			end := i + 1
+			for end < len(expression) && (isIdentStart(expression[end]) || isDigit(expression[end])) {
+				end++
+			}
+			tokens = append(tokens, Token{Kind: TokenIdent, Text: expression[i:end], Pos: i})
+			i = end
+		default:
+			if i+1 < len(expression) {
+				if kind, ok := twoCharTokens[expression[i:i+2]]; ok {
+					tokens = append(tokens, Token{Kind: kind, Text: expression[i : i+2], Pos: i})
+					i += 2
+					continue
+				}
+			}
+			kind, ok := singleCharTokens[c]
+			if !ok {
+				_, size := utf8.DecodeRuneInString(expression[i:])
+				return nil, &SyntaxError{
+					Expression: expression,
+					Offset:     i,
+					Token:      expression[i : i+size],
+					Expected:   "number, operator or parenthesis",
+				}
+			}
+			tokens = append(tokens, Token{Kind: kind, Text: expression[i : i+1], Pos: i})
+			i++
+		}
+	}
+	tokens = append(tokens, Token{Kind: TokenEOF, Pos: len(expression)})
+	return tokens, nil
+}
+
+// scanNumber returns the end offset of the number literal starting at start:
+// digits with an optional fraction and an optional exponent (1, 2.5, .5, 1e-3).
+func scanNumber(s string, start int) int {
+	i := start
+	digits := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+		digits++
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+			digits++
+		}
+	}
+	if digits == 0 {
+		return start
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			for j < len(s) && isDigit(s[j]) {
+				j++
+			}
+			i = j
+		}
+	}
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
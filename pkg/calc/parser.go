@@ -0,0 +1,215 @@
+package calc
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Binding powers of the calculator grammar, lowest first. Unary operators
+// bind tighter than multiplication but looser than exponentiation, so "-2^2"
+// is "-(2^2)" while "2^-1" still parses.
+const (
+	precNone = iota
+	precAdditive
+	precMultiplicative
+	precUnary
+	precPower
+)
+
+type operatorInfo struct {
+	prec       int
+	rightAssoc bool
+}
+
+var binaryOperators = map[TokenKind]operatorInfo{
+	TokenPlus:        {prec: precAdditive},
+	TokenMinus:       {prec: precAdditive},
+	TokenStar:        {prec: precMultiplicative},
+	TokenSlash:       {prec: precMultiplicative},
+	TokenPercent:     {prec: precMultiplicative},
+	TokenDoubleSlash: {prec: precMultiplicative},
+	TokenPower:       {prec: precPower, rightAssoc: true},
+}
+
+type parser struct {
+	expression string
+	tokens     []Token
+	pos        int
+}
+
+// Parse turns expression into an AST using the calculator grammar:
+//
+//	input   = [ identifier "=" ] expr
+//	expr    = unary { binop unary }
+//	unary   = ( "+" | "-" ) unary | power
+//	power   = primary [ ( "^" | "**" ) unary ]
+//	primary = number | identifier | call | "(" expr ")"
+//	call    = identifier "(" [ expr { "," expr } ] ")"
+//
+// binop is one of + - * / % //; exponentiation is right-associative.
+// A parenthesised group directly following an operand is an implicit
+// multiplication, so "3(4)" is 12.
+func Parse(expression string) (Node, error) {
+	if strings.TrimSpace(expression) == "" {
+		return nil, ErrEOF
+	}
+
+	tokens, err := Tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{expression: expression, tokens: tokens}
+	node, err := p.parseInput()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.Kind != TokenEOF {
+		return nil, p.errorAt(tok, "operator or end of expression")
+	}
+	return node, nil
+}
+
+func (p *parser) parseInput() (Node, error) {
+	if len(p.tokens) > 2 && p.tokens[0].Kind == TokenIdent && p.tokens[1].Kind == TokenAssign {
+		name := p.next()
+		p.next()
+		value, err := p.parseExpr(precAdditive)
+		if err != nil {
+			return nil, err
+		}
+		return &AssignExpr{Name: name.Text, NamePos: name.Pos, Value: value}, nil
+	}
+	return p.parseExpr(precAdditive)
+}
+
+func (p *parser) peek() Token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) errorAt(tok Token, expected string) *SyntaxError {
+	return &SyntaxError{
+		Expression: p.expression,
+		Offset:     tok.Pos,
+		Token:      tok.Text,
+		Expected:   expected,
+	}
+}
+
+func (p *parser) next() Token {
+	tok := p.tokens[p.pos]
+	if tok.Kind != TokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// parseExpr is a precedence climbing loop: it consumes binary operators
+// whose precedence is at least minPrec.
+func (p *parser) parseExpr(minPrec int) (Node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		tok := p.peek()
+		op, info, ok := p.binaryOperator(tok)
+		if !ok || info.prec < minPrec {
+			return left, nil
+		}
+		if op == tok.Kind {
+			p.next()
+		}
+
+		nextPrec := info.prec + 1
+		if info.rightAssoc {
+			nextPrec = info.prec
+		}
+		right, err := p.parseExpr(nextPrec)
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: op, X: left, Y: right, OpPos: tok.Pos}
+	}
+}
+
+// binaryOperator reports the operator that tok represents in infix position.
+// An opening parenthesis stands for an implicit multiplication.
+func (p *parser) binaryOperator(tok Token) (TokenKind, operatorInfo, bool) {
+	if tok.Kind == TokenLParen {
+		return TokenStar, binaryOperators[TokenStar], true
+	}
+	info, ok := binaryOperators[tok.Kind]
+	return tok.Kind, info, ok
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	tok := p.peek()
+	if tok.Kind == TokenPlus || tok.Kind == TokenMinus {
+		p.next()
+		operand, err := p.parseExpr(precUnary)
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Op: tok.Kind, X: operand, OpPos: tok.Pos}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	tok := p.next()
+	switch tok.Kind {
+	case TokenNumber:
+		value, err := strconv.ParseFloat(tok.Text, 64)
+		if err != nil {
+			return nil, p.errorAt(tok, "number in float64 range")
+		}
+		return &NumberLit{Value: value, Raw: tok.Text, Offset: tok.Pos}, nil
+
+	case TokenLParen:
+		inner, err := p.parseExpr(precAdditive)
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.Kind != TokenRParen {
+			return nil, p.errorAt(closing, "')'")
+		}
+		return &ParenExpr{X: inner, Lparen: tok.Pos}, nil
+
+	case TokenIdent:
+		if p.peek().Kind == TokenLParen {
+			return p.parseCall(tok)
+		}
+		return &Ident{Name: tok.Text, NamePos: tok.Pos}, nil
+
+	default:
+		return nil, p.errorAt(tok, "number, name or '('")
+	}
+}
+
+func (p *parser) parseCall(name Token) (Node, error) {
+	p.next()
+	call := &CallExpr{Name: name.Text, NamePos: name.Pos}
+	if p.peek().Kind == TokenRParen {
+		p.next()
+		return call, nil
+	}
+	for {
+		arg, err := p.parseExpr(precAdditive)
+		if err != nil {
+			return nil, err
+		}
+		call.Args = append(call.Args, arg)
+
+		tok := p.next()
+		switch tok.Kind {
+		case TokenComma:
+			continue
+		case TokenRParen:
+			return call, nil
+		default:
+			return nil, p.errorAt(tok, "',' or ')'")
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package calc
+
+import (
+	"context"
+	"log"
+)
+
+// OpNegate is the operation of a step that negates its only argument.
+const OpNegate = "neg"
+
+var operatorSymbols = map[TokenKind]string{
+	TokenPlus:        "+",
+	TokenMinus:       "-",
+	TokenStar:        "*",
+	TokenSlash:       "/",
+	TokenPower:       "^",
+	TokenPercent:     "%",
+	TokenDoubleSlash: "//",
+}
+
+var symbolOperators = map[string]TokenKind{
+	"+":  TokenPlus,
+	"-":  TokenMinus,
+	"*":  TokenStar,
+	"/":  TokenSlash,
+	"^":  TokenPower,
+	"%":  TokenPercent,
+	"//": TokenDoubleSlash,
+}
+
+// Operand is an argument of a Step: a known Value, or the result of the step
+// with index Step when Step >= 0.
+type Operand struct {
+	Value float64
+	Step  int
+}
+
+// Step is a single operation of a Plan: a binary operator ("+", "//", ...),
+// OpNegate or the name of a registered function.
+type Step struct {
+	Op   string
+	Args []Operand
+}
+
+// Deps returns the indexes of the steps this step waits for.
+func (s Step) Deps() []int {
+	var deps []int
+	for _, arg := range s.Args {
+		if arg.Step >= 0 {
+			deps = append(deps, arg.Step)
+		}
+	}
+	return deps
+}
+
+// Plan is an expression decomposed into a dependency graph of operations.
+// Steps are in topological order and the last one produces the result;
+// steps whose dependencies are done can run in parallel, so in
+// "(1+2)*(3+4)" both additions are independent.
+// A plan without steps is a constant equal to Value.
+type Plan struct {
+	Steps []Step
+	Value float64
+}
+
+// NewPlan parses expression and decomposes it into a Plan. Identifiers are
+// resolved against the built-in constants and env at planning time;
+// assignments are not allowed.
+func NewPlan(expression string, env map[string]float64) (*Plan, error) {
+	node, err := Parse(expression)
+	if err != nil {
+		return nil, err
+	}
+	if assign, ok := node.(*AssignExpr); ok {
+		return nil, checkAssignable(assign.Name, nil)
+	}
+
+	plan := &Plan{}
+	root, err := plan.add(node, env)
+	if err != nil {
+		return nil, err
+	}
+	if root.Step < 0 {
+		plan.Value = root.Value
+	}
+	return plan, nil
+}
+
+func (p *Plan) push(op string, args ...Operand) Operand {
+	p.Steps = append(p.Steps, Step{Op: op, Args: args})
+	return Operand{Step: len(p.Steps) - 1}
+}
+
+func (p *Plan) add(node Node, env map[string]float64) (Operand, error) {
+	switch n := node.(type) {
+	case *NumberLit:
+		return Operand{Value: n.Value, Step: -1}, nil
+
+	case *Ident:
+		value, err := lookupName(n.Name, env)
+		if err != nil {
+			return Operand{}, err
+		}
+		return Operand{Value: value, Step: -1}, nil
+
+	case *ParenExpr:
+		return p.add(n.X, env)
+
+	case *UnaryExpr:
+		operand, err := p.add(n.X, env)
+		if err != nil {
+			return Operand{}, err
+		}
+		if n.Op == TokenPlus {
+			return operand, nil
+		}
+		if operand.Step < 0 {
+			return Operand{Value: -operand.Value, Step: -1}, nil
+		}
+		return p.push(OpNegate, operand), nil
+
+	case *BinaryExpr:
+		op, ok := operatorSymbols[n.Op]
+		if !ok {
+			return Operand{}, ErrInvalidExpression
+		}
+		left, err := p.add(n.X, env)
+		if err != nil {
+			return Operand{}, err
+		}
+		right, err := p.add(n.Y, env)
+		if err != nil {
+			return Operand{}, err
+		}
+		return p.push(op, left, right), nil
+
+	case *CallExpr:
+		fn, ok := LookupFunction(n.Name)
+		if !ok {
+			return Operand{}, &FunctionError{Func: n.Name, Err: ErrUnknownFunction}
+		}
+		if err := fn.checkArity(len(n.Args)); err != nil {
+			return Operand{}, err
+		}
+		args := make([]Operand, 0, len(n.Args))
+		for _, arg := range n.Args {
+			operand, err := p.add(arg, env)
+			if err != nil {
+				return Operand{}, err
+			}
+			args = append(args, operand)
+		}
+		return p.push(n.Name, args...), nil
+
+	default:
+		return Operand{}, ErrInvalidExpression
+	}
+}
+
+// Apply runs a single plan operation on known arguments, honouring the
+// configured operator delay and ctx like EvalContext does.
+func (e *Evaluator) Apply(ctx context.Context, op string, args []float64) (float64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if kind, ok := symbolOperators[op]; ok {
+		if len(args) != 2 {
+			return 0, ErrArgumentCount
+		}
+		return e.binary(ctx, kind, args[0], args[1])
+	}
+	if op == OpNegate {
+		if len(args) != 1 {
+			return 0, ErrArgumentCount
+		}
+		return -args[0], nil
+	}
+
+	fn, ok := LookupFunction(op)
+	if !ok {
+		log.Printf("Apply: unknown operation: %s", op)
+		return 0, &FunctionError{Func: op, Err: ErrUnknownFunction}
+	}
+	return fn.apply(args)
+}
+
+// Apply runs op with the default evaluator.
+func Apply(ctx context.Context, op string, args []float64) (float64, error) {
+	return defaultEvaluator.Apply(ctx, op, args)
+}